@@ -18,9 +18,21 @@ func printVersion() {
 
 var DebugValue = false
 
+// Commands run instead of the server when their name is the first argument.
+var Commands map[string]func(args []string) error
+
+func init() {
+	Commands = map[string]func(args []string) error{
+		"openapi":  openAPICommand,
+		"import":   importCommand,
+		"snapshot": snapshotCommand,
+	}
+}
+
 var versionFlag = flag.Bool("version", false, "Print the current version and exit")
 var helpFlag = flag.Bool("help", false, "Print help message and exit")
 var debugFlag = flag.Bool("debug", false, "Enable debug logging")
+var regenerateFlag = flag.Bool("regenerate", false, "Discard stored data and generate all tables again from the entity files")
 
 func parseFlags() {
 	flag.BoolVar(versionFlag, "v", false, "Print the current version and exit")
@@ -36,8 +48,13 @@ func parseFlags() {
 	}
 
 	if *helpFlag || len(flag.Args()) >= 0 && flag.Arg(0) == "help" {
-		println("Usage:\n\tamock [host:port] [flags]")
+		println("Usage:\n\tamock [host:port] [flags]\n\tamock <command> [arguments] [flags]")
 		println("\n[host:port] - (optional) The host and port to bind the server to")
+		println("\nCommands:")
+		println("\topenapi [file]\tWrite the OpenAPI document of the mock to a file (default openapi.json, .yaml for YAML)")
+		println("\timport openapi <spec> [dir]\tCreate entity files from the schemas of an OpenAPI document (default dir is the configured dir or entities)")
+		println("\tsnapshot <save|restore|delete> <name>\tSave the data of all tables to .amock/snapshots, restore or delete it")
+		println("\tsnapshot list\tList the saved snapshots")
 		println("\nFlags: (optional)")
 		flag.PrintDefaults()
 		os.Exit(0)
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const AdminPath = "/__amock"
+
+// Seed is the state of a table when the server started, which the admin API can reset the table to.
+type Seed struct {
+	Rows       EntityCollection
+	LastAutoID uint
+}
+
+type TableInfo struct {
+	Name           string            `json:"name"`
+	DefinitionFile string            `json:"definitionFile"`
+	Rows           int               `json:"rows"`
+	LastAutoID     uint              `json:"lastAutoId"`
+	Schema         map[string]*Field `json:"schema"`
+}
+
+// RecordSeeds remembers the current rows of every table as their seeded state, which the tables of the database are
+// reset to.
+func RecordSeeds(database *Database) error {
+	database.seeds = make(map[string]Seed, len(database.Tables))
+
+	for name, table := range database.Tables {
+		collection, err := ReadTable(table)
+		if err != nil {
+			return err
+		}
+
+		database.seeds[name] = Seed{Rows: copyCollection(collection), LastAutoID: table.LastAutoID}
+	}
+
+	return nil
+}
+
+// ResetTable restores the rows and the ID sequence the table had when its database was seeded. Entities added since
+// then are removed like with a DELETE, so references to them are handled by their on-delete rules.
+func ResetTable(table *Table) error {
+	seed := table.Database().seeds[table.Name]
+
+	collection, err := ReadTable(table)
+	if err != nil {
+		return err
+	}
+
+	seeded := indexById(seed.Rows)
+
+	var added []string
+	for _, entity := range collection {
+		if _, ok := seeded[deleteKey(entity["id"])]; !ok {
+			added = append(added, IdKey(entity["id"]))
+		}
+	}
+
+	err = RemoveWithReferences(table, added...)
+	if err != nil {
+		return err
+	}
+
+	return restoreSeed(table, seed)
+}
+
+// ResetDatabase restores the seeded state of all tables of the database.
+func ResetDatabase(database *Database) error {
+	for _, table := range database.Tables {
+		err := restoreSeed(table, database.seeds[table.Name])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreSeed replaces the rows of the table with the seeded ones and publishes the changes.
+func restoreSeed(table *Table, seed Seed) error {
+	collection, err := ReadTable(table)
+	if err != nil {
+		return err
+	}
+
+	err = WriteTable(table, copyCollection(seed.Rows))
+	if err != nil {
+		return err
+	}
+
+	table.LastAutoID = seed.LastAutoID
+
+	seeded := indexById(seed.Rows)
+	for _, entity := range collection {
+		if _, ok := seeded[deleteKey(entity["id"])]; !ok {
+			PublishChange(EventDeleted, table, entity)
+		}
+	}
+
+	current := indexById(collection)
+	for _, entity := range seed.Rows {
+		if existing, ok := current[deleteKey(entity["id"])]; !ok {
+			PublishChange(EventCreated, table, entity)
+		} else if !reflect.DeepEqual(existing, entity) {
+			PublishChange(EventUpdated, table, entity)
+		}
+	}
+
+	return SaveTable(table)
+}
+
+// TruncateTable removes all entities of the table like a DELETE of each of them would.
+func TruncateTable(table *Table) error {
+	ids, err := table.Database().Storage.Ids(table)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = IdKey(id)
+	}
+
+	return RemoveWithReferences(table, keys...)
+}
+
+// TruncateDatabase removes the entities of all tables of the database.
+func TruncateDatabase(database *Database) error {
+	for _, table := range database.Tables {
+		collection, err := ReadTable(table)
+		if err == nil {
+			err = removeRows(table, collection)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GenerateRows generates count new entities from the stored definition of the table and inserts them.
+func GenerateRows(table *Table, count int) (EntityCollection, error) {
+	generated := make(EntityCollection, 0, count)
+
+	for i := 0; i < count; i++ {
+		entity := Entity{}
+		for key, field := range table.Definition {
+			if !field.Children {
+				entity[key], table = GenerateEntityField(*field, table)
+			}
+		}
+
+		err := AppendTable(table, &entity)
+		if err != nil {
+			return nil, err
+		}
+
+		generated = append(generated, normalizeEntity(entity))
+	}
+
+	return generated, nil
+}
+
+func indexById(collection EntityCollection) map[string]Entity {
+	index := make(map[string]Entity, len(collection))
+	for _, entity := range collection {
+		index[deleteKey(entity["id"])] = entity
+	}
+
+	return index
+}
+
+func copyCollection(collection EntityCollection) EntityCollection {
+	copied := make(EntityCollection, len(collection))
+	for i, entity := range collection {
+		copied[i] = normalizeEntity(entity)
+	}
+
+	return copied
+}
+
+// requireAdmin rejects requests without the admin token when one is configured.
+func requireAdmin(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if config.AdminToken != "" {
+			token := r.Header.Get("X-Amock-Token")
+			if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+				token = bearer
+			}
+
+			if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="amock"`)
+				http.Error(w, "Invalid or missing admin token", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handle(w, r, ps)
+	}
+}
+
+func InitAdminHandlers(router *httprouter.Router) {
+	router.GET(AdminPath+"/tables", requireAdmin(databaseHandler(handleAdminTables)))
+	router.GET(AdminPath+"/tables/:table", requireAdmin(withAdminTable(handleAdminTable)))
+	router.POST(AdminPath+"/tables/:table/reset", requireAdmin(withAdminTable(handleAdminResetTable)))
+	router.POST(AdminPath+"/tables/:table/truncate", requireAdmin(withAdminTable(handleAdminTruncateTable)))
+	router.POST(AdminPath+"/tables/:table/generate", requireAdmin(withAdminTable(handleAdminGenerate)))
+	router.POST(AdminPath+"/reset", requireAdmin(databaseHandler(handleAdminReset)))
+	router.POST(AdminPath+"/truncate", requireAdmin(databaseHandler(handleAdminTruncate)))
+	router.GET(AdminPath+"/snapshots", requireAdmin(handleListSnapshots))
+	router.GET(AdminPath+"/snapshots/:name", requireAdmin(handleDownloadSnapshot))
+	router.POST(AdminPath+"/snapshots/:name", requireAdmin(handleSaveSnapshot))
+	router.POST(AdminPath+"/snapshots/:name/restore", requireAdmin(handleRestoreSnapshot))
+	router.DELETE(AdminPath+"/snapshots/:name", requireAdmin(handleDeleteSnapshot))
+	router.GET(AdminPath+"/scenarios", requireAdmin(handleListScenarios))
+	router.GET(AdminPath+"/scenario", requireAdmin(handleGetScenario))
+	router.PUT(AdminPath+"/scenario", requireAdmin(handleActivateScenario))
+	router.GET(AdminPath+"/sessions", requireAdmin(handleListSessions))
+	router.DELETE(AdminPath+"/sessions/:id", requireAdmin(handleCloseSession))
+	router.GET(WebhookDeliveriesPath, requireAdmin(handleWebhookDeliveries))
+}
+
+// withAdminTable resolves the table of the database selected by the scenario or session of the request.
+func withAdminTable(handle func(http.ResponseWriter, *http.Request, *Table)) httprouter.Handle {
+	return databaseHandler(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+		table, ok := database.Tables[ps.ByName("table")]
+		if !ok {
+			http.Error(w, "Unknown table: "+ps.ByName("table"), http.StatusNotFound)
+			return
+		}
+
+		handle(w, r, table)
+	})
+}
+
+func tableInfo(table *Table) (TableInfo, error) {
+	collection, err := ReadTable(table)
+	if err != nil {
+		return TableInfo{}, err
+	}
+
+	return TableInfo{
+		Name:           table.Name,
+		DefinitionFile: table.DefinitionFile,
+		Rows:           len(collection),
+		LastAutoID:     table.LastAutoID,
+		Schema:         table.Definition,
+	}, nil
+}
+
+func handleAdminTables(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+	tables := make([]TableInfo, 0, len(database.Tables))
+
+	for _, name := range sortedTableNames(database.Tables) {
+		info, err := tableInfo(database.Tables[name])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		tables = append(tables, info)
+	}
+
+	writeAdminJSON(w, http.StatusOK, tables)
+}
+
+func handleAdminTable(w http.ResponseWriter, r *http.Request, table *Table) {
+	info, err := tableInfo(table)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+func handleAdminResetTable(w http.ResponseWriter, r *http.Request, table *Table) {
+	unlock := table.Database().LockAll()
+	defer unlock()
+
+	err := ResetTable(table)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Table " + table.Name + " reset", "rows": len(table.Database().seeds[table.Name].Rows)})
+}
+
+func handleAdminTruncateTable(w http.ResponseWriter, r *http.Request, table *Table) {
+	unlock := table.Database().LockAll()
+	defer unlock()
+
+	err := TruncateTable(table)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Table " + table.Name + " truncated"})
+}
+
+func handleAdminGenerate(w http.ResponseWriter, r *http.Request, table *Table) {
+	count := 1
+	if param := r.URL.Query().Get("count"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid count: "+param, http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+
+	unlock := table.LockForWrite()
+	defer unlock()
+
+	generated, err := GenerateRows(table, count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusCreated, generated)
+}
+
+// handleAdminReset resets the database selected by the scenario or session header of the request. Without them, the
+// default database and all scenarios are reset and the sessions are closed.
+func handleAdminReset(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+	everything := r.Header.Get(ScenarioHeader) == "" && requestSession(r) == ""
+	if everything {
+		database = &db
+	}
+
+	unlock := database.LockAll()
+	err := ResetDatabase(database)
+	unlock()
+
+	if err == nil && everything {
+		err = ResetScenarios()
+		sessions.CloseAll()
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Database reset"})
+}
+
+func handleAdminTruncate(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+	unlock := database.LockAll()
+	defer unlock()
+
+	err := TruncateDatabase(database)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Database truncated"})
+}
+
+// writeAdminError responds with 409 if the change was refused because of a reference.
+func writeAdminError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrReferenced) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, value any) {
+	content, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	_, _ = w.Write(content)
+}
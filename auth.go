@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	TokensJWT    = "jwt"
+	TokensOpaque = "opaque"
+)
+
+var (
+	ErrInvalidToken           = errors.New("invalid token")
+	ErrAuthenticationRequired = errors.New("authentication required")
+	ErrForbidden              = errors.New("forbidden")
+)
+
+type AuthConfig struct {
+	// Table holds the users that can log in. Authentication is disabled without it.
+	Table         string     `yaml:"table" json:"table"`
+	Path          string     `yaml:"path" json:"path"`
+	UsernameField string     `yaml:"usernameField" json:"usernameField"`
+	PasswordField string     `yaml:"passwordField" json:"passwordField"`
+	RoleField     string     `yaml:"roleField" json:"roleField"`
+	Tokens        string     `yaml:"tokens" json:"tokens"`
+	Secret        string     `yaml:"secret" json:"secret"`
+	Expiry        int        `yaml:"expiry" json:"expiry"`
+	RefreshExpiry int        `yaml:"refreshExpiry" json:"refreshExpiry"`
+	Rules         []AuthRule `yaml:"rules" json:"rules"`
+	OIDC          OIDCConfig `yaml:"oidc" json:"oidc"`
+}
+
+// AuthRule requires a token for the methods of the tables. With roles, the user must also have one of them.
+type AuthRule struct {
+	Tables  []string `yaml:"tables" json:"tables"`
+	Methods []string `yaml:"methods" json:"methods"`
+	Roles   []string `yaml:"roles" json:"roles"`
+}
+
+func (r AuthRule) Matches(table string, method string) bool {
+	return matchesAny(r.Tables, table) && matchesAny(r.Methods, method)
+}
+
+func matchesAny(list []string, value string) bool {
+	if len(list) == 0 || slices.Contains(list, "*") {
+		return true
+	}
+
+	return slices.ContainsFunc(list, func(item string) bool { return strings.EqualFold(item, value) })
+}
+
+// Principal is the user a token was issued to.
+type Principal struct {
+	Subject  string    `json:"sub"`
+	Username string    `json:"name,omitempty"`
+	Role     string    `json:"role,omitempty"`
+	TokenId  string    `json:"jti"`
+	Expires  time.Time `json:"-"`
+}
+
+type refreshToken struct {
+	principal Principal
+	expires   time.Time
+}
+
+// Auth issues and checks the tokens. Opaque and refresh tokens, and JWTs revoked by logging out, are kept in memory.
+type Auth struct {
+	mu      sync.Mutex
+	config  AuthConfig
+	secret  []byte
+	access  map[string]Principal
+	refresh map[string]refreshToken
+	revoked map[string]time.Time
+}
+
+var auth *Auth
+
+func NewAuth(cfg AuthConfig) *Auth {
+	if cfg.Path == "" {
+		cfg.Path = "/auth"
+	}
+	cfg.Path = "/" + strings.Trim(cfg.Path, "/")
+	if cfg.UsernameField == "" {
+		cfg.UsernameField = "username"
+	}
+	if cfg.PasswordField == "" {
+		cfg.PasswordField = "password"
+	}
+	if cfg.RoleField == "" {
+		cfg.RoleField = "role"
+	}
+	if cfg.Tokens == "" {
+		cfg.Tokens = TokensJWT
+	}
+	if cfg.Expiry <= 0 {
+		cfg.Expiry = 3600
+	}
+	if cfg.RefreshExpiry <= 0 {
+		cfg.RefreshExpiry = 86400
+	}
+
+	secret := []byte(cfg.Secret)
+	if len(secret) == 0 {
+		// Without a configured secret, tokens don't survive a restart.
+		secret = []byte(randomToken())
+	}
+
+	return &Auth{
+		config:  cfg,
+		secret:  secret,
+		access:  map[string]Principal{},
+		refresh: map[string]refreshToken{},
+		revoked: map[string]time.Time{},
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Login checks the credentials against the users table and returns the user without the password.
+func (a *Auth) Login(table *Table, username string, password string) (Entity, error) {
+	collection, err := ReadTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range collection {
+		if user[a.config.UsernameField] == nil || fmt.Sprint(user[a.config.UsernameField]) != username {
+			continue
+		}
+
+		stored := fmt.Sprint(user[a.config.PasswordField])
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1 {
+			return a.publicUser(user), nil
+		}
+	}
+
+	return nil, errors.New("invalid credentials")
+}
+
+func (a *Auth) publicUser(user Entity) Entity {
+	public := Entity(cloneObject(user))
+	delete(public, a.config.PasswordField)
+
+	return public
+}
+
+func (a *Auth) principal(user Entity) Principal {
+	principal := Principal{Subject: fmt.Sprint(user["id"])}
+
+	if username, ok := user[a.config.UsernameField]; ok && username != nil {
+		principal.Username = fmt.Sprint(username)
+	}
+	if role, ok := user[a.config.RoleField]; ok && role != nil {
+		principal.Role = fmt.Sprint(role)
+	}
+
+	return principal
+}
+
+// Issue returns a new access token and refresh token for the principal.
+func (a *Auth) Issue(principal Principal) (string, string, error) {
+	now := time.Now()
+	principal.TokenId = randomToken()[:32]
+	principal.Expires = now.Add(time.Duration(a.config.Expiry) * time.Second)
+
+	var access string
+	if a.config.Tokens == TokensOpaque {
+		access = randomToken()
+	} else {
+		var err error
+		access, err = a.signJWT(principal, now)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	refresh := randomToken()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expire(now)
+	if a.config.Tokens == TokensOpaque {
+		a.access[access] = principal
+	}
+	a.refresh[refresh] = refreshToken{principal, now.Add(time.Duration(a.config.RefreshExpiry) * time.Second)}
+
+	return access, refresh, nil
+}
+
+// Refresh exchanges the refresh token for new tokens. The refresh token can only be used once.
+func (a *Auth) Refresh(token string) (Principal, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stored, ok := a.refresh[token]
+	delete(a.refresh, token)
+
+	if !ok || time.Now().After(stored.expires) {
+		return Principal{}, ErrInvalidToken
+	}
+
+	return stored.principal, nil
+}
+
+// Revoke invalidates the access token with the ID and all refresh tokens issued with it.
+func (a *Auth) Revoke(principal Principal) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.revoked[principal.TokenId] = principal.Expires
+
+	for token, stored := range a.access {
+		if stored.TokenId == principal.TokenId {
+			delete(a.access, token)
+		}
+	}
+
+	for token, stored := range a.refresh {
+		if stored.principal.TokenId == principal.TokenId {
+			delete(a.refresh, token)
+		}
+	}
+}
+
+// Verify returns the principal of a valid access token.
+func (a *Auth) Verify(token string) (Principal, error) {
+	var principal Principal
+
+	if a.config.Tokens == TokensOpaque {
+		a.mu.Lock()
+		stored, ok := a.access[token]
+		a.mu.Unlock()
+
+		if !ok {
+			return principal, ErrInvalidToken
+		}
+		principal = stored
+	} else {
+		var err error
+		principal, err = a.parseJWT(token)
+		if err != nil {
+			return principal, err
+		}
+	}
+
+	if time.Now().After(principal.Expires) {
+		return principal, fmt.Errorf("%w: token expired", ErrInvalidToken)
+	}
+
+	a.mu.Lock()
+	_, revoked := a.revoked[principal.TokenId]
+	a.mu.Unlock()
+
+	if revoked {
+		return principal, fmt.Errorf("%w: token revoked", ErrInvalidToken)
+	}
+
+	return principal, nil
+}
+
+// expire removes the tokens that expired. The caller must hold the lock.
+func (a *Auth) expire(now time.Time) {
+	for token, principal := range a.access {
+		if now.After(principal.Expires) {
+			delete(a.access, token)
+		}
+	}
+	for token, stored := range a.refresh {
+		if now.After(stored.expires) {
+			delete(a.refresh, token)
+		}
+	}
+	for id, expires := range a.revoked {
+		if now.After(expires) {
+			delete(a.revoked, id)
+		}
+	}
+}
+
+type jwtClaims struct {
+	Principal
+	IssuedAt  int64 `json:"iat"`
+	ExpiresAt int64 `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (a *Auth) signJWT(principal Principal, now time.Time) (string, error) {
+	claims, err := json.Marshal(jwtClaims{principal, now.Unix(), principal.Expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	return unsigned + "." + a.signature(unsigned), nil
+}
+
+func (a *Auth) parseJWT(token string) (Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return Principal{}, ErrInvalidToken
+	}
+
+	if !hmac.Equal([]byte(parts[2]), []byte(a.signature(parts[0]+"."+parts[1]))) {
+		return Principal{}, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return Principal{}, ErrInvalidToken
+	}
+
+	var claims jwtClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return Principal{}, ErrInvalidToken
+	}
+
+	claims.Principal.Expires = time.Unix(claims.ExpiresAt, 0)
+
+	return claims.Principal, nil
+}
+
+func (a *Auth) signature(unsigned string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(unsigned))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type principalContextKey struct{}
+
+// RequestPrincipal returns the user authenticated by the bearer token of the request.
+func RequestPrincipal(r *http.Request) (Principal, bool) {
+	return ContextPrincipal(r.Context())
+}
+
+func ContextPrincipal(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalContextKey{}).(Principal)
+	return principal, ok
+}
+
+func bearerToken(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// Authorize checks the auth rules matching the method on the table for the principal of the context. It returns
+// ErrAuthenticationRequired for anonymous callers and ErrForbidden for users without one of the roles of a rule.
+func Authorize(ctx context.Context, table string, method string) error {
+	if auth == nil {
+		return nil
+	}
+
+	principal, authenticated := ContextPrincipal(ctx)
+
+	for _, rule := range auth.config.Rules {
+		if !rule.Matches(table, method) {
+			continue
+		}
+
+		if !authenticated {
+			return ErrAuthenticationRequired
+		}
+
+		if len(rule.Roles) > 0 && !slices.Contains(rule.Roles, principal.Role) {
+			return ErrForbidden
+		}
+	}
+
+	return nil
+}
+
+// handleAuthorizeError responds with 401 or 403 for an error of Authorize.
+func handleAuthorizeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrForbidden) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="amock"`)
+	message := "Authentication required"
+	if bearerToken(r) != "" {
+		message = "Invalid or expired token"
+	}
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// Authenticate stores the principal of a valid bearer token in the request context and rejects the requests the
+// auth rules don't allow. The internal endpoints under /__amock/ have their own token, and the event streams among
+// them check the rules of each table they send.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil || strings.HasPrefix(r.URL.Path, auth.config.Path+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := auth.Verify(bearerToken(r))
+		if err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, principal))
+		}
+
+		if strings.HasPrefix(r.URL.Path, AdminPath+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		table := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+
+		err = Authorize(r.Context(), table, r.Method)
+		if err != nil {
+			handleAuthorizeError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func InitAuthHandlers(router *httprouter.Router) {
+	router.POST(auth.config.Path+"/login", handleLogin)
+	router.POST(auth.config.Path+"/refresh", handleRefresh)
+	router.POST(auth.config.Path+"/logout", handleLogout)
+	router.GET(auth.config.Path+"/me", handleMe)
+}
+
+func usersTable(w http.ResponseWriter, r *http.Request) (*Table, bool) {
+	database, err := RequestDatabase(r)
+	if err != nil {
+		http.Error(w, "Unknown scenario: "+r.Header.Get(ScenarioHeader), http.StatusBadRequest)
+		return nil, false
+	}
+
+	table, ok := database.Tables[auth.config.Table]
+	if !ok {
+		http.Error(w, "Unknown users table: "+auth.config.Table, http.StatusInternalServerError)
+		return nil, false
+	}
+
+	return table, true
+}
+
+func writeTokens(w http.ResponseWriter, principal Principal, user Entity) {
+	access, refresh, err := auth.Issue(principal)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]any{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    auth.config.Expiry,
+		"refresh_token": refresh,
+	}
+	if user != nil {
+		response["user"] = user
+	}
+
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body map[string]any
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	username, _ := body[auth.config.UsernameField].(string)
+	password, _ := body[auth.config.PasswordField].(string)
+	if username == "" || password == "" {
+		http.Error(w, "Missing "+auth.config.UsernameField+" or "+auth.config.PasswordField, http.StatusBadRequest)
+		return
+	}
+
+	table, ok := usersTable(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := auth.Login(table, username, password)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	writeTokens(w, auth.principal(user), user)
+}
+
+func handleRefresh(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	principal, err := auth.Refresh(body.RefreshToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	writeTokens(w, principal, nil)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	principal, err := auth.Verify(bearerToken(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="amock"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	auth.Revoke(principal)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	principal, err := auth.Verify(bearerToken(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="amock"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	table, ok := usersTable(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := FindById(table, principal.Subject)
+	if err != nil {
+		handleFindError(w, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, auth.publicUser(user))
+}
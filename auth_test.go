@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAuthTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(newTestServer(t, Config{
+		GraphQL: true,
+		Auth: AuthConfig{
+			Table: "user",
+			Rules: []AuthRule{
+				{Tables: []string{"post"}, Methods: []string{"GET"}},
+				{Tables: []string{"user"}, Methods: []string{"DELETE"}, Roles: []string{"admin"}},
+			},
+		},
+	}, testEntities))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func issueToken(t *testing.T, principal Principal) string {
+	t.Helper()
+
+	token, _, err := auth.Issue(principal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func graphQLErrors(t *testing.T, server *httptest.Server, query string, headers ...string) []string {
+	t.Helper()
+
+	res, content := request(t, http.MethodPost, server.URL+GraphQLPath, map[string]any{"query": query}, headers...)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GraphQL responded with %d: %s", res.StatusCode, content)
+	}
+
+	var result struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	err := json.Unmarshal(content, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []string
+	for _, e := range result.Errors {
+		messages = append(messages, e.Message)
+	}
+
+	return messages
+}
+
+func TestGraphQLAuthRules(t *testing.T) {
+	server := newAuthTestServer(t)
+	user := "Bearer " + issueToken(t, Principal{Subject: "1", Role: "user"})
+	admin := "Bearer " + issueToken(t, Principal{Subject: "2", Role: "admin"})
+
+	tests := []struct {
+		name    string
+		query   string
+		headers []string
+		err     error
+	}{
+		{"list without token", `{ allPost { id } }`, nil, ErrAuthenticationRequired},
+		{"get without token", `{ post(id: 1) { id } }`, nil, ErrAuthenticationRequired},
+		{"children without token", `{ allUser { id posts { id } } }`, nil, ErrAuthenticationRequired},
+		{"unprotected table without token", `{ allUser { id } }`, nil, nil},
+		{"list with token", `{ allPost { id user { id } } }`, []string{"Authorization", user}, nil},
+		{"delete without role", `mutation { deleteUser(id: 1) { id } }`, []string{"Authorization", user}, ErrForbidden},
+		{"delete with role", `mutation { deleteUser(id: 1) { id } }`, []string{"Authorization", admin}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := graphQLErrors(t, server, test.query, test.headers...)
+
+			if test.err == nil && len(messages) > 0 {
+				t.Errorf("expected no errors, got %v", messages)
+			}
+			if test.err != nil && (len(messages) == 0 || messages[0] != test.err.Error()) {
+				t.Errorf("expected the error %q, got %v", test.err, messages)
+			}
+		})
+	}
+}
+
+func TestRelationsAuthRules(t *testing.T) {
+	server := newAuthTestServer(t)
+	user := "Bearer " + issueToken(t, Principal{Subject: "1", Role: "user"})
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers []string
+		status  int
+	}{
+		{"children without token", http.MethodGet, "/user/1/posts", nil, http.StatusUnauthorized},
+		{"embed without token", http.MethodGet, "/user/1?_embed=posts", nil, http.StatusUnauthorized},
+		{"embed in list without token", http.MethodGet, "/user?_embed=posts", nil, http.StatusUnauthorized},
+		{"expand without token", http.MethodGet, "/post/1?_expand=user", nil, http.StatusUnauthorized},
+		{"unprotected table without token", http.MethodGet, "/user/1", nil, http.StatusOK},
+		{"children with token", http.MethodGet, "/user/1/posts", []string{"Authorization", user}, http.StatusOK},
+		{"embed with token", http.MethodGet, "/user?_embed=posts", []string{"Authorization", user}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, content := request(t, test.method, server.URL+test.url, nil, test.headers...)
+			if res.StatusCode != test.status {
+				t.Errorf("expected %d, got %d: %s", test.status, res.StatusCode, content)
+			}
+		})
+	}
+}
+
+func TestNestedCreateAuthRules(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{
+		Auth: AuthConfig{
+			Table: "user",
+			Rules: []AuthRule{{Tables: []string{"post"}, Methods: []string{"POST"}, Roles: []string{"admin"}}},
+		},
+	}, testEntities))
+	t.Cleanup(server.Close)
+
+	user := "Bearer " + issueToken(t, Principal{Subject: "1", Role: "user"})
+	admin := "Bearer " + issueToken(t, Principal{Subject: "2", Role: "admin"})
+	post := map[string]any{"title": "Hello"}
+
+	res, _ := request(t, http.MethodPost, server.URL+"/user/1/posts", post)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 creating a child without token, got %d", res.StatusCode)
+	}
+
+	res, _ = request(t, http.MethodPost, server.URL+"/user/1/posts", post, "Authorization", user)
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 creating a child without role, got %d", res.StatusCode)
+	}
+
+	res, content := request(t, http.MethodPost, server.URL+"/user/1/posts", post, "Authorization", admin)
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 creating a child with role, got %d: %s", res.StatusCode, content)
+	}
+}
+
+func TestEventsAuthRules(t *testing.T) {
+	server := newAuthTestServer(t)
+
+	res, _ := request(t, http.MethodGet, server.URL+EventsPath+"?tables=post", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the events of a protected table, got %d", res.StatusCode)
+	}
+
+	res, _ = request(t, http.MethodGet, server.URL+"/post/_events", nil)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for the events of a protected table, got %d", res.StatusCode)
+	}
+
+	res, err := http.Get(server.URL + EventsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Wait for the subscription before changing the tables.
+	<-lines
+
+	request(t, http.MethodPost, server.URL+"/post", map[string]any{"user_id": 1, "title": "Hidden"})
+	request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "Jane"})
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+
+			var event Event
+			err = json.Unmarshal([]byte(data), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Table != "user" {
+				t.Fatalf("expected only the events of the unprotected tables, got one of %s", event.Table)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for the event")
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DelayHeader     = "X-Amock-Delay"
+	StatusHeader    = "X-Amock-Status"
+	FaultHeader     = "X-Amock-Fault"
+	BandwidthHeader = "X-Amock-Bandwidth"
+)
+
+const (
+	FaultDrop      = "drop"
+	FaultTruncate  = "truncate"
+	FaultMalformed = "malformed"
+)
+
+// ChaosConfig describes the faults injected into responses. Unset fields are inherited from the less specific
+// settings.
+type ChaosConfig struct {
+	// Delay is a fixed delay ("200") or a range ("100-500") in milliseconds.
+	Delay         string   `yaml:"delay" json:"delay"`
+	ErrorRate     *float64 `yaml:"errorRate" json:"errorRate"`
+	ErrorStatus   []int    `yaml:"errorStatus" json:"errorStatus"`
+	DropRate      *float64 `yaml:"dropRate" json:"dropRate"`
+	TruncateRate  *float64 `yaml:"truncateRate" json:"truncateRate"`
+	MalformedRate *float64 `yaml:"malformedRate" json:"malformedRate"`
+	// Bandwidth limits the speed of sending the body in bytes per second.
+	Bandwidth *int `yaml:"bandwidth" json:"bandwidth"`
+}
+
+type ChaosTableConfig struct {
+	ChaosConfig `yaml:",inline"`
+	Methods     map[string]ChaosConfig `yaml:"methods" json:"methods"`
+}
+
+type ChaosSettings struct {
+	ChaosConfig `yaml:",inline"`
+	Methods     map[string]ChaosConfig      `yaml:"methods" json:"methods"`
+	Tables      map[string]ChaosTableConfig `yaml:"tables" json:"tables"`
+}
+
+// Resolve merges the global settings with the settings of the method, the table and the method of the table.
+func (s ChaosSettings) Resolve(table string, method string) ChaosConfig {
+	resolved := s.ChaosConfig
+	resolved = resolved.merge(s.Methods[method])
+
+	if tableConfig, ok := s.Tables[table]; ok {
+		resolved = resolved.merge(tableConfig.ChaosConfig)
+		resolved = resolved.merge(tableConfig.Methods[method])
+	}
+
+	return resolved
+}
+
+func (c ChaosConfig) merge(other ChaosConfig) ChaosConfig {
+	if other.Delay != "" {
+		c.Delay = other.Delay
+	}
+	if other.ErrorRate != nil {
+		c.ErrorRate = other.ErrorRate
+	}
+	if len(other.ErrorStatus) > 0 {
+		c.ErrorStatus = other.ErrorStatus
+	}
+	if other.DropRate != nil {
+		c.DropRate = other.DropRate
+	}
+	if other.TruncateRate != nil {
+		c.TruncateRate = other.TruncateRate
+	}
+	if other.MalformedRate != nil {
+		c.MalformedRate = other.MalformedRate
+	}
+	if other.Bandwidth != nil {
+		c.Bandwidth = other.Bandwidth
+	}
+
+	return c
+}
+
+// Fault is what happens to a single request.
+type Fault struct {
+	Delay     time.Duration
+	Status    int
+	Kind      string
+	Bandwidth int
+}
+
+func (c ChaosConfig) fault() (Fault, error) {
+	var fault Fault
+
+	delay, err := randomDelay(c.Delay)
+	if err != nil {
+		return fault, err
+	}
+	fault.Delay = delay
+
+	switch {
+	case chance(c.DropRate):
+		fault.Kind = FaultDrop
+	case chance(c.ErrorRate):
+		fault.Status = http.StatusInternalServerError
+		if len(c.ErrorStatus) > 0 {
+			fault.Status = c.ErrorStatus[rand.IntN(len(c.ErrorStatus))]
+		}
+	case chance(c.TruncateRate):
+		fault.Kind = FaultTruncate
+	case chance(c.MalformedRate):
+		fault.Kind = FaultMalformed
+	}
+
+	if c.Bandwidth != nil {
+		fault.Bandwidth = *c.Bandwidth
+	}
+
+	return fault, nil
+}
+
+// requestFault applies the chaos headers of the request to the fault.
+func requestFault(r *http.Request, fault Fault) (Fault, error) {
+	if value := r.Header.Get(DelayHeader); value != "" {
+		delay, err := randomDelay(value)
+		if err != nil {
+			return fault, err
+		}
+		fault.Delay = delay
+	}
+
+	if value := r.Header.Get(StatusHeader); value != "" {
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 100 || status > 599 {
+			return fault, fmt.Errorf("invalid %s header: %s", StatusHeader, value)
+		}
+		fault.Status = status
+		fault.Kind = ""
+	}
+
+	if value := r.Header.Get(FaultHeader); value != "" {
+		switch value {
+		case FaultDrop, FaultTruncate, FaultMalformed:
+			fault.Kind = value
+			fault.Status = 0
+		default:
+			return fault, fmt.Errorf("invalid %s header: %s", FaultHeader, value)
+		}
+	}
+
+	if value := r.Header.Get(BandwidthHeader); value != "" {
+		bandwidth, err := strconv.Atoi(value)
+		if err != nil || bandwidth < 0 {
+			return fault, fmt.Errorf("invalid %s header: %s", BandwidthHeader, value)
+		}
+		fault.Bandwidth = bandwidth
+	}
+
+	return fault, nil
+}
+
+func randomDelay(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	low, high, isRange := strings.Cut(value, "-")
+
+	minimum, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil || minimum < 0 {
+		return 0, fmt.Errorf("invalid delay: %s", value)
+	}
+
+	maximum := minimum
+	if isRange {
+		maximum, err = strconv.Atoi(strings.TrimSpace(high))
+		if err != nil || maximum < minimum {
+			return 0, fmt.Errorf("invalid delay: %s", value)
+		}
+	}
+
+	return time.Duration(minimum+rand.IntN(maximum-minimum+1)) * time.Millisecond, nil
+}
+
+func chance(rate *float64) bool {
+	return rate != nil && *rate > 0 && rand.Float64() < *rate
+}
+
+// Chaos injects the faults from the chaos settings and the chaos headers into the responses. The internal endpoints
+// under /__amock/ are never affected.
+func Chaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, AdminPath+"/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		table := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")[0]
+
+		fault, err := config.Chaos.Resolve(table, r.Method).fault()
+		if err == nil {
+			fault, err = requestFault(r, fault)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if fault.Delay > 0 {
+			select {
+			case <-time.After(fault.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if fault.Kind == FaultDrop {
+			conn, _, err := http.NewResponseController(w).Hijack()
+			if err == nil {
+				_ = conn.Close()
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}
+
+		if fault.Status != 0 {
+			http.Error(w, http.StatusText(fault.Status), fault.Status)
+			return
+		}
+
+		// Event streams are sent as they're written, so their body can't be changed.
+		if (fault.Kind == "" && fault.Bandwidth == 0) || strings.HasSuffix(r.URL.Path, "/_events") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		buffer := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(buffer, r)
+
+		body := buffer.body.Bytes()
+		switch fault.Kind {
+		case FaultTruncate:
+			body = body[:len(body)/2]
+		case FaultMalformed:
+			body = malformJSON(body)
+		}
+
+		for key, values := range buffer.header {
+			w.Header()[key] = values
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(buffer.status)
+
+		writeThrottled(w, r, body, fault.Bandwidth)
+	})
+}
+
+// malformJSON breaks the syntax of the body by removing a random delimiter, or appending one if there's none.
+func malformJSON(body []byte) []byte {
+	var positions []int
+	for i, c := range body {
+		if bytes.IndexByte([]byte(`{}[]:,"`), c) >= 0 {
+			positions = append(positions, i)
+		}
+	}
+
+	if len(positions) == 0 {
+		return append(body, '}')
+	}
+
+	i := positions[rand.IntN(len(positions))]
+
+	return append(body[:i:i], body[i+1:]...)
+}
+
+// writeThrottled writes the body in chunks, ten per second, so that the bandwidth isn't exceeded.
+func writeThrottled(w http.ResponseWriter, r *http.Request, body []byte, bandwidth int) {
+	if bandwidth <= 0 {
+		_, _ = w.Write(body)
+		return
+	}
+
+	chunk := max(bandwidth/10, 1)
+	controller := http.NewResponseController(w)
+
+	for len(body) > 0 {
+		n := min(chunk, len(body))
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		_ = controller.Flush()
+		body = body[n:]
+
+		if len(body) > 0 {
+			select {
+			case <-time.After(time.Second * time.Duration(n) / time.Duration(bandwidth)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// started is the modification time of the tables that weren't changed since the server started.
+var started = time.Now()
+
+var modificationsMu sync.Mutex
+
+// Touch records that the entities with the IDs were changed. Without IDs, all entities of the table were replaced.
+func Touch(table *Table, ids ...string) {
+	modificationsMu.Lock()
+	defer modificationsMu.Unlock()
+
+	now := time.Now()
+	table.modified = now
+
+	if len(ids) == 0 {
+		table.replaced = now
+		table.modifiedIds = nil
+		return
+	}
+
+	if table.modifiedIds == nil {
+		table.modifiedIds = map[string]time.Time{}
+	}
+	for _, id := range ids {
+		table.modifiedIds[id] = now
+	}
+}
+
+// inheritModifications copies the modification times of the table to the session's copy of it.
+func inheritModifications(table *Table, source *Table) {
+	modificationsMu.Lock()
+	defer modificationsMu.Unlock()
+
+	table.modified = source.modified
+	table.replaced = source.replaced
+	table.modifiedIds = make(map[string]time.Time, len(source.modifiedIds))
+	for id, modified := range source.modifiedIds {
+		table.modifiedIds[id] = modified
+	}
+}
+
+// modificationSource returns the table the data of a session is read from until the session changes it.
+func modificationSource(table *Table) *Table {
+	if storage, ok := table.Database().Storage.(*CopyOnWriteStorage); ok {
+		_, source := storage.source(table)
+		return source
+	}
+
+	return table
+}
+
+func TableModified(table *Table) time.Time {
+	table = modificationSource(table)
+
+	modificationsMu.Lock()
+	defer modificationsMu.Unlock()
+
+	if table.modified.IsZero() {
+		return started
+	}
+
+	return table.modified
+}
+
+func EntityModified(table *Table, id string) time.Time {
+	table = modificationSource(table)
+
+	modificationsMu.Lock()
+	defer modificationsMu.Unlock()
+
+	if modified, ok := table.modifiedIds[id]; ok {
+		return modified
+	}
+	if table.replaced.IsZero() {
+		return started
+	}
+
+	return table.replaced
+}
+
+// relationsModified returns the latest modification of the table, or of the whole database if the response embeds
+// other tables.
+func relationsModified(table *Table, query url.Values, modified time.Time) time.Time {
+	if query.Get("_embed") == "" && query.Get("_expand") == "" {
+		return modified
+	}
+
+	for _, other := range table.Database().Tables {
+		if otherModified := TableModified(other); otherModified.After(modified) {
+			modified = otherModified
+		}
+	}
+
+	return modified
+}
+
+func ETag(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:12]) + `"`
+}
+
+// EntityETag returns the ETag of the entity, which is the same as the one of its GET response.
+func EntityETag(entity Entity) string {
+	content, err := json.Marshal(entity)
+	if err != nil {
+		return ""
+	}
+
+	return ETag(content)
+}
+
+// matchesETag reports whether the tag is in the list of an If-Match or If-None-Match header. The weak comparison
+// ignores the W/ prefix.
+func matchesETag(header string, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// notModified sets the validators of the response. If the client's cached copy is still fresh, it responds with 304
+// and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, tag string, modified time.Time) bool {
+	w.Header().Set("ETag", tag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if !matchesETag(header, tag, true) {
+			return false
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+
+	return true
+}
+
+// checkPreconditions checks the If-Match and If-Unmodified-Since headers of a change to the entity. If-Match accepts
+// the ETag of any format. It responds with 412 if the entity changed since the client read it, or 428 if If-Match is
+// required but missing.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, table *Table, entity Entity) bool {
+	tag := EntityETag(entity)
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		matches := slices.ContainsFunc(slices.Collect(maps.Keys(formatContentTypes)), func(format string) bool {
+			return matchesETag(header, FormatETag(tag, format), false)
+		})
+		if !matches {
+			w.Header().Set("ETag", tag)
+			http.Error(w, "Precondition failed: the entity was modified", http.StatusPreconditionFailed)
+			return false
+		}
+		return true
+	}
+
+	if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil {
+		if EntityModified(table, IdKey(entity["id"])).Truncate(time.Second).After(since) {
+			http.Error(w, "Precondition failed: the entity was modified", http.StatusPreconditionFailed)
+			return false
+		}
+		return true
+	}
+
+	if config.RequireIfMatch {
+		http.Error(w, "Precondition required: send the ETag of the entity in the If-Match header", http.StatusPreconditionRequired)
+		return false
+	}
+
+	return true
+}
@@ -7,15 +7,23 @@ import (
 	"log"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jwalton/gchalk"
 )
 
 type Database struct {
-	Tables map[string]Table
+	Tables  map[string]*Table
+	Storage Storage
+	// Scenario is the name of the scenario the database was built for, empty for the default database.
+	Scenario string
+	// Session is the ID of the session the database belongs to, if any.
+	Session string
+	seeds   map[string]Seed
 }
 
 type Table struct {
@@ -25,6 +33,12 @@ type Table struct {
 	Definition     map[string]*Field
 	SchemaFile     string
 	LastAutoID     uint
+	mu             sync.Mutex
+	db             *Database
+	modified       time.Time
+	replaced       time.Time
+	modifiedIds    map[string]time.Time
+	saveTimer      *time.Timer
 }
 
 type Entity map[string]any
@@ -46,13 +60,13 @@ type Sort struct {
 }
 
 type PaginatedItems struct {
-	First int
-	Last  int
-	Prev  int
-	Next  int
-	Pages int
-	Count int
-	Items EntityCollection
+	First int              `json:"first"`
+	Last  int              `json:"last"`
+	Prev  int              `json:"prev"`
+	Next  int              `json:"next"`
+	Pages int              `json:"pages"`
+	Count int              `json:"count"`
+	Items EntityCollection `json:"items"`
 }
 
 type EntityIds map[string]uint
@@ -61,34 +75,52 @@ func GenerateEntity(entity EntityJSON, table *Table) (Entity, *Table) {
 	fields := make(Entity, len(entity))
 
 	for key, value := range entity {
-		options := FieldOptions{false, false, false}
-		fieldName := key
-
-		if strings.HasSuffix(key, "!") {
-			options.Required = true
-			fieldName = strings.TrimSuffix(key, "!")
-		} else if strings.HasSuffix(key, "?") {
-			options.Nullable = true
-			fieldName = strings.TrimSuffix(key, "?")
-		} else if strings.HasSuffix(key, "[]") {
-			options.Children = true
-			fieldName = strings.TrimSuffix(key, "[]")
+		fieldName, options := ParseFieldKey(key)
+
+		if options.Children {
+			table.Definition[fieldName] = ChildrenField(value)
+			continue
 		}
+
 		fields[fieldName], table = GenerateField(fieldName, value, table, options)
 	}
 
 	return fields, table
 }
 
+// ParseFieldKey splits the property name of an entity file into the field name and the options set by its suffix.
+func ParseFieldKey(key string) (string, FieldOptions) {
+	options := FieldOptions{false, false, false}
+	fieldName := key
+
+	if strings.HasSuffix(key, "!") {
+		options.Required = true
+		fieldName = strings.TrimSuffix(key, "!")
+	} else if strings.HasSuffix(key, "?") {
+		options.Nullable = true
+		fieldName = strings.TrimSuffix(key, "?")
+	} else if strings.HasSuffix(key, "[]") {
+		options.Children = true
+		fieldName = strings.TrimSuffix(key, "[]")
+	}
+
+	return fieldName, options
+}
+
 func HydrateDatabase(db *Database) *Database {
 	now := time.Now()
 	Debug("Building database...")
 
 	var entityJSON EntityJSON
 
-	for key, table := range db.Tables {
-		updated := CreateTable(&table, entityJSON)
-		db.Tables[key] = *updated
+	for _, key := range HydrationOrder(db.Tables) {
+		db.Tables[key].db = db
+		db.Tables[key] = CreateTable(db.Tables[key], entityJSON)
+	}
+
+	err := db.Storage.Flush()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	elapsed := time.Since(now).String()
@@ -102,56 +134,279 @@ func CreateTable(table *Table, entityJSON EntityJSON) *Table {
 	dir := path.Join(DataDir, filename)
 	schemaDir := path.Join(SchemaDir, table.Name+".amock.schema.json")
 
-	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
-		if _, err = os.Stat(schemaDir); !errors.Is(err, os.ErrNotExist) {
-			Debug("Table "+gchalk.Bold(table.Name)+" found at "+gchalk.Italic(dir)+" - skipping...", "table", table.Name, "file", dir, "schema", schemaDir)
-			table.File = dir
-			table.SchemaFile = schemaDir
+	table.File = dir
+	table.SchemaFile = schemaDir
+	storage := table.Database().Storage
 
-			var schema []byte
-			schema, err = os.ReadFile(table.SchemaFile)
-			if err != nil {
-				log.Fatal(err)
-			}
+	entityJSON, err := ReadDefinition(table)
 
-			err = json.Unmarshal(schema, &table.Definition)
-			if err != nil {
-				log.Fatal(err)
-			}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !*regenerateFlag && storage.Exists(table) {
+		Debug("Table "+gchalk.Bold(table.Name)+" found in "+gchalk.Italic(config.Storage)+" storage - skipping...", "table", table.Name, "file", dir, "schema", schemaDir)
+
+		stored, err := storage.LoadSchema(table)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		migration, err := MigrateTable(table, stored, entityJSON)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !migration.Empty() {
+			fmt.Println(migration)
+		}
+
+		WarnReferences(table)
 
-			return table
+		err = ReconcileAutoID(table)
+		if err != nil {
+			log.Fatal(err)
 		}
+
+		err = SaveTable(table)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return table
 	}
 
-	raw, err := os.ReadFile(table.DefinitionFile)
+	table.Definition = make(map[string]*Field)
+	table.LastAutoID = 1
+
+	entities := make([]Entity, config.InitCount)
 
+	for i := 0; i < config.InitCount; i++ {
+		entities[i], table = GenerateEntity(entityJSON, table)
+	}
+
+	WarnReferences(table)
+
+	err = storage.SaveSchema(table)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = json.Unmarshal(raw, &entityJSON)
+	err = storage.Replace(table, entities)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	entities := make([]Entity, config.InitCount)
+	err = SaveTable(table)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for i := 0; i < config.InitCount; i++ {
-		entities[i], table = GenerateEntity(entityJSON, table)
+	Debug("Table "+gchalk.Bold(table.Name)+" created in "+gchalk.Italic(config.Storage)+" storage from file "+gchalk.Bold(table.DefinitionFile), "table", table.Name, "file", dir, "schema", table.DefinitionFile)
+
+	return table
+}
+
+// Database returns the database the table belongs to, which differs from the default one for tables of a scenario.
+func (t *Table) Database() *Database {
+	if t.db == nil {
+		return &db
 	}
 
-	schema, _ := json.Marshal(table.Definition)
-	_ = os.WriteFile(schemaDir, schema, os.ModePerm)
+	return t.db
+}
 
-	b, _ := json.Marshal(entities)
+// Columns returns the stored fields of the table, id first and the rest in alphabetical order.
+func (t *Table) Columns() []string {
+	columns := []string{"id"}
 
-	_ = os.WriteFile(dir, b, os.ModePerm)
+	for key, field := range t.Definition {
+		if key != "id" && !field.Children {
+			columns = append(columns, key)
+		}
+	}
 
-	table.File = dir
+	slices.Sort(columns[1:])
+
+	return columns
+}
 
-	Debug("Table "+gchalk.Bold(table.Name)+" created at "+gchalk.Italic(dir)+" from file "+gchalk.Bold(table.DefinitionFile), "table", table.Name, "file", dir, "schema", table.DefinitionFile)
+func (t *Table) MetaFile() string {
+	return path.Join(TablesDir, path.Base(t.DefinitionFile)+".table")
+}
 
-	return table
+// SaveTable writes the metadata of the table to the tables directory, so that the ID sequence continues where it left
+// off after a restart. Only the default database is persisted, the tables of scenarios and sessions share the metadata
+// file of the default table and don't write it.
+func SaveTable(table *Table) error {
+	if table.Database() != &db {
+		return nil
+	}
+
+	b, err := json.Marshal(table)
+	if err != nil {
+		return fmt.Errorf("could not marshal table %s: %w", table.Name, err)
+	}
+
+	return WriteFileAtomic(table.MetaFile(), b)
+}
+
+var saveMu sync.Mutex
+
+// ScheduleSaveTable saves the metadata of the table in the background, debounced by config.FlushDelay like the data of
+// the table.
+func ScheduleSaveTable(table *Table) {
+	if table.Database() != &db {
+		return
+	}
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	if table.saveTimer != nil {
+		return
+	}
+
+	table.saveTimer = time.AfterFunc(time.Duration(config.FlushDelay)*time.Millisecond, func() {
+		if err := FlushTable(table); err != nil {
+			Error("Error writing table metadata", "table", table.Name, "error", err)
+		}
+	})
+}
+
+// FlushTable saves the metadata of the table right away if a save is scheduled. If it fails, the save is scheduled
+// again.
+func FlushTable(table *Table) error {
+	saveMu.Lock()
+	if table.saveTimer == nil {
+		saveMu.Unlock()
+		return nil
+	}
+	table.saveTimer.Stop()
+	table.saveTimer = nil
+	saveMu.Unlock()
+
+	table.mu.Lock()
+	err := SaveTable(table)
+	table.mu.Unlock()
+
+	if err != nil {
+		ScheduleSaveTable(table)
+	}
+
+	return err
+}
+
+// FlushTables saves the metadata of the tables of the default database that have a save scheduled.
+func FlushTables() error {
+	var errs []error
+	for _, table := range db.Tables {
+		errs = append(errs, FlushTable(table))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ReconcileAutoID moves LastAutoID past the highest ID stored in the table, in case rows were added by other means
+// (or the metadata got lost) since the table was last saved.
+func ReconcileAutoID(table *Table) error {
+	var keys []string
+	for key, field := range table.Definition {
+		if field.Type == "id" && field.Subtype != "uuid" {
+			keys = append(keys, key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	collection, err := ReadTable(table)
+	if err != nil {
+		return err
+	}
+
+	if table.LastAutoID < 1 {
+		table.LastAutoID = 1
+	}
+
+	for _, entity := range collection {
+		for _, key := range keys {
+			if n, ok := toFloat(entity[key]); ok && n >= 0 && uint(n) >= table.LastAutoID {
+				table.LastAutoID = uint(n) + 1
+			}
+		}
+	}
+
+	return nil
+}
+
+func ReadDefinition(table *Table) (EntityJSON, error) {
+	raw, err := os.ReadFile(table.DefinitionFile)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not read file %s: %w", table.DefinitionFile, err)
+	}
+
+	var entityJSON EntityJSON
+
+	err = json.Unmarshal(raw, &entityJSON)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal file %s: %w", table.DefinitionFile, err)
+	}
+
+	return entityJSON, nil
+}
+
+// LockTables locks the tables for writing and returns a function that unlocks them. Tables are always locked in the
+// same order, so handlers locking several tables can't deadlock.
+func LockTables(tables ...*Table) func() {
+	sorted := make([]*Table, 0, len(tables))
+	for _, table := range tables {
+		if !slices.Contains(sorted, table) {
+			sorted = append(sorted, table)
+		}
+	}
+
+	slices.SortFunc(sorted, func(a, b *Table) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	for _, table := range sorted {
+		table.mu.Lock()
+	}
+
+	return func() {
+		for i := len(sorted) - 1; i >= 0; i-- {
+			sorted[i].mu.Unlock()
+		}
+	}
+}
+
+// LockForWrite locks the table together with the tables its references point to, so that referenced entities can't
+// be deleted while the entity is being validated and saved.
+func (t *Table) LockForWrite() func() {
+	tables := []*Table{t}
+
+	for _, field := range t.Definition {
+		if ref := field.Reference(); ref != nil {
+			if target, ok := t.Database().Tables[ref.Table]; ok {
+				tables = append(tables, target)
+			}
+		}
+	}
+
+	return LockTables(tables...)
+}
+
+// LockAll locks every table, which is needed when a change can cascade through references.
+func (db *Database) LockAll() func() {
+	tables := make([]*Table, 0, len(db.Tables))
+	for _, table := range db.Tables {
+		tables = append(tables, table)
+	}
+
+	return LockTables(tables...)
 }
 
 // func SearchTable(table *Table, filters map[string]any) (EntityCollection, error) {
@@ -159,43 +414,58 @@ func CreateTable(table *Table, entityJSON EntityJSON) *Table {
 // }
 
 func GetTable(table *Table) ([]byte, error) {
-	raw, err := os.ReadFile(table.File)
+	collection, err := ReadTable(table)
 
 	if err != nil {
-		return nil, fmt.Errorf("could not read file %s: %w", table.File, err)
+		return nil, err
 	}
 
-	return raw, err
+	b, err := json.Marshal(collection)
+
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal collection: %w", err)
+	}
+
+	return b, nil
 }
 
 func GetEntityById(table *Table, id string) ([]byte, error) {
-	collection, err := ReadTable(table)
+	entity, err := FindById(table, id)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		entity *Entity
-		found  bool
-	)
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal entity: %w", err)
+	}
+
+	return b, err
+}
 
-	newId, err := strconv.ParseFloat(id, 64)
+func FindById(table *Table, id string) (Entity, error) {
+	entity, found, err := table.Database().Storage.Get(table, id)
 	if err != nil {
-		entity, found = FindBy[string](&collection, "id", id)
-	} else {
-		entity, found = FindBy[float64](&collection, "id", newId)
+		return nil, err
 	}
 
 	if !found {
 		return nil, errors.New("entity not found, id: " + id)
 	}
 
-	b, err := json.Marshal(entity)
-	if err != nil {
-		return nil, fmt.Errorf("could not marshal entity: %w", err)
+	return entity, nil
+}
+
+func MatchesId(value any, id string) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case float64:
+		n, err := strconv.ParseFloat(id, 64)
+		return err == nil && n == v
 	}
 
-	return b, err
+	return fmt.Sprint(value) == id
 }
 
 func FindBy[T comparable](collection *EntityCollection, key string, search T) (*Entity, bool) {
@@ -211,69 +481,72 @@ func FindBy[T comparable](collection *EntityCollection, key string, search T) (*
 }
 
 func ReadTable(table *Table) (EntityCollection, error) {
-	raw, err := GetTable(table)
-
-	if err != nil {
-		return nil, err
-	}
-
-	var collection EntityCollection
-
-	err = json.Unmarshal(raw, &collection)
-	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal file %s: %w", table.File, err)
-	}
+	return table.Database().Storage.All(table)
+}
 
-	return collection, err
+func QueryTable(table *Table, filters []Filter) (EntityCollection, error) {
+	return table.Database().Storage.Query(table, filters)
 }
 
 func WriteTable(table *Table, collection EntityCollection) error {
-	b, err := json.Marshal(collection)
-
+	err := table.Database().Storage.Replace(table, collection)
 	if err != nil {
-		return fmt.Errorf("could not marshal collection: %w", err)
+		return err
 	}
 
-	err = os.WriteFile(table.File, b, os.ModePerm)
+	Touch(table)
 
-	return err
+	return nil
 }
 
 func AppendTable(table *Table, entity *Entity) error {
-	collection, err := ReadTable(table)
-
+	err := table.Database().Storage.Insert(table, *entity)
 	if err != nil {
 		return err
 	}
 
-	collection = append(collection, *entity)
+	Touch(table, IdKey((*entity)["id"]))
+	PublishChange(EventCreated, table, *entity)
+	ScheduleSaveTable(table)
 
-	err = WriteTable(table, collection)
-
-	return err
+	return nil
 }
 
 func RemoveById(table *Table, id string) error {
-	collection, err := ReadTable(table)
-
 	Debug("Removing entity", "id", id, "table", table.Name)
 
+	entity, _, err := table.Database().Storage.Get(table, id)
 	if err != nil {
 		return err
 	}
 
-	for i, entity := range collection {
-		if entity["id"] == id {
-			collection = append(collection[:i], collection[i+1:]...)
-			break
-		}
+	found, err := table.Database().Storage.Delete(table, id)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		Touch(table, IdKey(entity["id"]))
+		PublishChange(EventDeleted, table, entity)
 	}
 
-	err = WriteTable(table, collection)
+	return nil
+}
 
+func UpdateById(table *Table, id string, entity *Entity) error {
+	Debug("Updating entity", "id", id, "table", table.Name)
+
+	found, err := table.Database().Storage.Update(table, id, *entity)
 	if err != nil {
 		return err
 	}
 
+	if !found {
+		return errors.New("entity not found, id: " + id)
+	}
+
+	Touch(table, IdKey((*entity)["id"]))
+	PublishChange(EventUpdated, table, *entity)
+
 	return nil
 }
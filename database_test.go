@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentWrites creates, updates and deletes entities from parallel clients. No write may get lost and every
+// created entity must get its own ID. Run it with -race.
+func TestConcurrentWrites(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{}, testEntities))
+	defer server.Close()
+
+	const clients = 8
+	const creates = 20
+
+	var mu sync.Mutex
+	ids := map[string]bool{}
+
+	var wg sync.WaitGroup
+	for client := range clients {
+		wg.Go(func() {
+			for i := range creates {
+				res, err := http.Post(server.URL+"/user", "application/json", strings.NewReader(`{"name": "Jane"}`))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				var user Entity
+				err = json.NewDecoder(res.Body).Decode(&user)
+				res.Body.Close()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mu.Lock()
+				id := IdKey(user["id"])
+				if ids[id] {
+					t.Errorf("duplicate ID %s", id)
+				}
+				ids[id] = true
+				mu.Unlock()
+
+				// Interleave the other operations with the creates.
+				switch i % 4 {
+				case 0:
+					request(t, http.MethodGet, server.URL+"/user?_embed=posts", nil)
+				case 1:
+					request(t, http.MethodPatch, server.URL+"/user/"+id, map[string]any{"name": "Client " + strconv.Itoa(client)})
+				case 2:
+					request(t, http.MethodPost, server.URL+"/user/"+id+"/posts", map[string]any{"title": "Hello"})
+				case 3:
+					request(t, http.MethodDelete, server.URL+"/user/"+id, nil)
+					mu.Lock()
+					delete(ids, id)
+					mu.Unlock()
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	_, content := request(t, http.MethodGet, server.URL+"/user", nil)
+
+	var users EntityCollection
+	err := json.Unmarshal(content, &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The users created by the clients and not deleted again, and the generated ones.
+	if len(users) != len(ids)+config.InitCount {
+		t.Errorf("expected %d users, got %d", len(ids)+config.InitCount, len(users))
+	}
+
+	_, content = request(t, http.MethodGet, server.URL+"/post", nil)
+
+	var posts EntityCollection
+	err = json.Unmarshal(content, &posts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, post := range posts {
+		if !ids[IdKey(post["user_id"])] && post["user_id"].(float64) > float64(config.InitCount) {
+			t.Errorf("post %v of a deleted user was kept", post["id"])
+		}
+	}
+
+	res, content := request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "John"})
+	expected := `"id":` + strconv.Itoa(config.InitCount+clients*creates+1)
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(content), expected) {
+		t.Errorf("expected the ID sequence to continue after the concurrent creates, got %d: %s", res.StatusCode, content)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+const EventsPath = "/__amock/events"
+const WebSocketPath = "/__amock/ws"
+
+type Event struct {
+	Id        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Table     string    `json:"table"`
+	EntityId  any       `json:"entityId"`
+	Entity    Entity    `json:"entity"`
+	Time      time.Time `json:"time"`
+	Synthetic bool      `json:"synthetic,omitempty"`
+	Scenario  string    `json:"scenario,omitempty"`
+	Session   string    `json:"session,omitempty"`
+}
+
+// EventBus passes table changes to the subscribed clients. Slow subscribers miss events instead of blocking writes.
+type EventBus struct {
+	mu          sync.Mutex
+	lastId      uint64
+	subscribers map[chan Event]subscription
+	listeners   []func(Event)
+}
+
+type subscription struct {
+	tables []string
+	accept func(Event) bool
+}
+
+var Events = NewEventBus()
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[chan Event]subscription{}}
+}
+
+// Subscribe returns a channel receiving the events of the tables, or of all tables if none are given. If accept is
+// set, only the events it accepts are received.
+func (b *EventBus) Subscribe(accept func(Event) bool, tables ...string) chan Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, 64)
+	b.subscribers[ch] = subscription{tables, accept}
+
+	return ch
+}
+
+func (b *EventBus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Listen registers a function called with every event. It runs while publishing, so it must not block.
+func (b *EventBus) Listen(listener func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, listener)
+}
+
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastId++
+	event.Id = b.lastId
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	for _, listener := range b.listeners {
+		listener(event)
+	}
+
+	for ch, subscriber := range b.subscribers {
+		if len(subscriber.tables) > 0 && !slices.Contains(subscriber.tables, event.Table) {
+			continue
+		}
+		if subscriber.accept != nil && !subscriber.accept(event) {
+			continue
+		}
+
+		select {
+		case ch <- event:
+		default:
+			Warn("Dropping event for slow subscriber", "event", event.Id, "table", event.Table)
+		}
+	}
+}
+
+func PublishChange(eventType string, table *Table, entity Entity) {
+	Events.Publish(Event{
+		Type:     eventType,
+		Table:    table.Name,
+		EntityId: entity["id"],
+		Entity:   normalizeEntity(entity),
+		Scenario: table.Database().Scenario,
+		Session:  table.Database().Session,
+	})
+}
+
+// Accepts reports whether the event is a change of the database. Clients only get the events of the scenario or
+// session their requests use.
+func (d *Database) Accepts(event Event) bool {
+	return event.Scenario == d.Scenario && event.Session == d.Session
+}
+
+// eventFilter returns the filter of the events streamed to the client of the request: the changes of its database in
+// the tables the auth rules let it read, to the entities it owns. It responds with 401 or 403 if one of the requested
+// tables isn't readable.
+func eventFilter(w http.ResponseWriter, r *http.Request, database *Database, tables []string) (func(Event) bool, bool) {
+	ctx := r.Context()
+	caller := RequestCaller(r)
+
+	for _, table := range tables {
+		if err := Authorize(ctx, table, http.MethodGet); err != nil {
+			handleAuthorizeError(w, r, err)
+			return nil, false
+		}
+	}
+
+	return func(event Event) bool {
+		if !database.Accepts(event) || Authorize(ctx, event.Table, http.MethodGet) != nil {
+			return false
+		}
+
+		table, ok := database.Tables[event.Table]
+
+		return !ok || caller.Owner(table).Owns(event.Entity)
+	}, true
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request, database *Database, tables ...string) {
+	accept, ok := eventFilter(w, r, database, tables)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := Events.Subscribe(accept, tables...)
+	defer Events.Unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	_, _ = fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, _ = fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event := <-events:
+			content, err := json.Marshal(event)
+			if err != nil {
+				Error("Error encoding event", "error", err)
+				continue
+			}
+
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, content)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+	tables := splitParam(r.URL.Query()["tables"])
+
+	accept, ok := eventFilter(w, r, database, tables)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	events := Events.Subscribe(accept, tables...)
+	defer Events.Unsubscribe(events)
+
+	closed := make(chan struct{})
+
+	// Reading is needed to process pings and close messages from the client.
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-events:
+			err = conn.WriteJSON(event)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func handleAllEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params, database *Database) {
+	handleEvents(w, r, database, splitParam(r.URL.Query()["tables"])...)
+}
+
+// StartSyntheticEvents publishes an event with generated data for a random table every interval. The generated
+// entities aren't stored.
+func StartSyntheticEvents(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	names := sortedTableNames(db.Tables)
+	if len(names) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			table := db.Tables[names[rand.IntN(len(names))]]
+			event, ok := syntheticEvent(table)
+			if ok {
+				Events.Publish(event)
+			}
+		}
+	}()
+}
+
+func syntheticEvent(table *Table) (Event, bool) {
+	// Generate into a scratch table, so the ID sequence of the real table doesn't move.
+	unlock := LockTables(table)
+	scratch := &Table{Name: table.Name, Definition: table.Definition, LastAutoID: table.LastAutoID}
+	unlock()
+
+	event := Event{Table: table.Name, Synthetic: true}
+	existing, _ := ReadTable(table)
+
+	switch rand.IntN(3) {
+	case 0:
+		event.Type = EventCreated
+		event.Entity = Entity{}
+		for key, field := range scratch.Definition {
+			if !field.Children {
+				event.Entity[key], scratch = GenerateEntityField(*field, scratch)
+			}
+		}
+	case 1:
+		if len(existing) == 0 {
+			return event, false
+		}
+		event.Type = EventUpdated
+		event.Entity = existing[rand.IntN(len(existing))]
+		for key, field := range scratch.Definition {
+			if key != "id" && !field.Children && field.Type != "ref" && rand.IntN(2) == 0 {
+				event.Entity[key], scratch = GenerateEntityField(*field, scratch)
+			}
+		}
+	default:
+		if len(existing) == 0 {
+			return event, false
+		}
+		event.Type = EventDeleted
+		event.Entity = existing[rand.IntN(len(existing))]
+	}
+
+	event.Entity = normalizeEntity(event.Entity)
+	event.EntityId = event.Entity["id"]
+
+	return event, true
+}
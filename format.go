@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatXML    = "xml"
+	FormatYAML   = "yaml"
+	FormatNDJSON = "ndjson"
+)
+
+var formatContentTypes = map[string]string{
+	FormatJSON:   "application/json",
+	FormatCSV:    "text/csv; charset=utf-8",
+	FormatXML:    "application/xml; charset=utf-8",
+	FormatYAML:   "application/yaml; charset=utf-8",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+var formatMediaTypes = map[string]string{
+	"application/json":     FormatJSON,
+	"text/csv":             FormatCSV,
+	"application/xml":      FormatXML,
+	"text/xml":             FormatXML,
+	"application/yaml":     FormatYAML,
+	"application/x-yaml":   FormatYAML,
+	"text/yaml":            FormatYAML,
+	"application/x-ndjson": FormatNDJSON,
+	"application/ndjson":   FormatNDJSON,
+	"application/jsonl":    FormatNDJSON,
+	"*/*":                  FormatJSON,
+	"application/*":        FormatJSON,
+}
+
+// requestFormat returns the format selected by the `_format` query parameter or the Accept header of the request. It
+// responds with 400 for an unknown `_format` and with 406 if none of the accepted media types is supported.
+func requestFormat(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+
+	if format := strings.ToLower(r.URL.Query().Get("_format")); format != "" {
+		if format == "jsonl" {
+			format = FormatNDJSON
+		}
+		if _, ok := formatContentTypes[format]; !ok {
+			http.Error(w, "Unknown format: "+format, http.StatusBadRequest)
+			return "", false
+		}
+		return format, true
+	}
+
+	accept := r.Header.Get("Accept")
+	// Browsers prefer XML over anything else they accept, so they get JSON like clients without a preference.
+	if accept == "" || strings.Contains(accept, "text/html") {
+		return FormatJSON, true
+	}
+
+	type candidate struct {
+		format      string
+		quality     float64
+		specificity int
+	}
+	var candidates []candidate
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		format, ok := formatMediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		// Exact media types win over `type/*`, which wins over `*/*`, when they have the same quality.
+		specificity := 2
+		if mediaType == "*/*" {
+			specificity = 0
+		} else if strings.HasSuffix(mediaType, "/*") {
+			specificity = 1
+		}
+
+		if quality > 0 {
+			candidates = append(candidates, candidate{format, quality, specificity})
+		}
+	}
+
+	if len(candidates) == 0 {
+		http.Error(w, "Not acceptable, supported media types: application/json, text/csv, application/xml, application/yaml, application/x-ndjson", http.StatusNotAcceptable)
+		return "", false
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].quality != candidates[j].quality {
+			return candidates[i].quality > candidates[j].quality
+		}
+		return candidates[i].specificity > candidates[j].specificity
+	})
+
+	return candidates[0].format, true
+}
+
+// FormatETag returns the ETag of the representation in the format, derived from the ETag of the JSON representation.
+func FormatETag(tag string, format string) string {
+	if format == FormatJSON || tag == "" {
+		return tag
+	}
+
+	return strings.TrimSuffix(tag, `"`) + "-" + format + `"`
+}
+
+// writeFormatted writes the collection, or the single entity if one is true, in the format.
+func writeFormatted(w http.ResponseWriter, table *Table, format string, collection EntityCollection, one bool) {
+	var content []byte
+	var err error
+
+	switch format {
+	case FormatCSV:
+		content, err = encodeCSV(table, collection)
+	case FormatXML:
+		content = encodeXML(table, collection, one)
+	case FormatYAML:
+		content, err = encodeYAML(table, collection, one)
+	case FormatNDJSON:
+		content, err = encodeNDJSON(collection)
+	default:
+		if one {
+			content, err = json.Marshal(collection[0])
+		} else {
+			content, err = json.Marshal(collection)
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	if format == FormatCSV && !one {
+		w.Header().Set("Content-Disposition", `attachment; filename="`+table.Name+`.csv"`)
+	}
+
+	_, _ = w.Write(content)
+}
+
+// formatColumns returns the columns of the table followed by the other fields of the entities, like embedded
+// relations.
+func formatColumns(table *Table, collection EntityCollection) []string {
+	columns := table.Columns()
+
+	var extra []string
+	for _, entity := range collection {
+		for key := range entity {
+			if !slices.Contains(columns, key) && !slices.Contains(extra, key) {
+				extra = append(extra, key)
+			}
+		}
+	}
+	slices.Sort(extra)
+
+	return append(columns, extra...)
+}
+
+func encodeCSV(table *Table, collection EntityCollection) ([]byte, error) {
+	columns := formatColumns(table, collection)
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	err := writer.Write(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entity := range collection {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i], err = csvValue(entity[column])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = writer.Write(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	writer.Flush()
+
+	return buffer.Bytes(), writer.Error()
+}
+
+// csvValue formats the value of a cell. Lists and objects are written as JSON.
+func csvValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool, int, int64, uint:
+		return fmt.Sprint(v), nil
+	}
+
+	content, err := json.Marshal(value)
+
+	return string(content), err
+}
+
+func encodeXML(table *Table, collection EntityCollection, one bool) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(xml.Header)
+
+	name := xmlName(table.Name)
+
+	if one {
+		writeXMLElement(&buffer, name, collection[0], formatColumns(table, collection), "")
+		return buffer.Bytes()
+	}
+
+	buffer.WriteString(`<collection table="` + name + `">` + "\n")
+	columns := formatColumns(table, collection)
+	for _, entity := range collection {
+		writeXMLElement(&buffer, name, entity, columns, "  ")
+	}
+	buffer.WriteString("</collection>\n")
+
+	return buffer.Bytes()
+}
+
+// writeXMLElement writes the value as an element. Objects become child elements, lists repeat an <item> element and
+// null becomes an empty element.
+func writeXMLElement(buffer *bytes.Buffer, name string, value any, columns []string, indent string) {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteString(indent + "<" + name + "/>\n")
+	case map[string]any, Entity:
+		object, ok := v.(map[string]any)
+		if !ok {
+			object = v.(Entity)
+		}
+
+		keys := columns
+		if keys == nil {
+			keys = make([]string, 0, len(object))
+			for key := range object {
+				keys = append(keys, key)
+			}
+			slices.Sort(keys)
+		}
+
+		buffer.WriteString(indent + "<" + name + ">\n")
+		for _, key := range keys {
+			if child, ok := object[key]; ok {
+				writeXMLElement(buffer, xmlName(key), child, nil, indent+"  ")
+			}
+		}
+		buffer.WriteString(indent + "</" + name + ">\n")
+	case []any, EntityCollection:
+		items, ok := v.([]any)
+		if !ok {
+			for _, entity := range v.(EntityCollection) {
+				items = append(items, map[string]any(entity))
+			}
+		}
+
+		buffer.WriteString(indent + "<" + name + ">\n")
+		for _, item := range items {
+			writeXMLElement(buffer, "item", item, nil, indent+"  ")
+		}
+		buffer.WriteString(indent + "</" + name + ">\n")
+	default:
+		text, _ := csvValue(v)
+		buffer.WriteString(indent + "<" + name + ">")
+		_ = xml.EscapeText(buffer, []byte(text))
+		buffer.WriteString("</" + name + ">\n")
+	}
+}
+
+// xmlName replaces the characters that aren't allowed in element names.
+func xmlName(name string) string {
+	valid := []rune(name)
+	for i, c := range valid {
+		if !unicode.IsLetter(c) && c != '_' && (i == 0 || (!unicode.IsDigit(c) && c != '-' && c != '.')) {
+			valid[i] = '_'
+		}
+	}
+
+	if len(valid) == 0 {
+		return "_"
+	}
+
+	return string(valid)
+}
+
+func encodeYAML(table *Table, collection EntityCollection, one bool) ([]byte, error) {
+	columns := formatColumns(table, collection)
+
+	var document yaml.Node
+	if one {
+		node, err := yamlEntity(collection[0], columns)
+		if err != nil {
+			return nil, err
+		}
+		document = *node
+	} else {
+		document = yaml.Node{Kind: yaml.SequenceNode}
+		for _, entity := range collection {
+			node, err := yamlEntity(entity, columns)
+			if err != nil {
+				return nil, err
+			}
+			document.Content = append(document.Content, node)
+		}
+	}
+
+	return yaml.Marshal(&document)
+}
+
+// yamlEntity builds a mapping with the fields of the entity in the order of the columns.
+func yamlEntity(entity Entity, columns []string) (*yaml.Node, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, column := range columns {
+		value, ok := entity[column]
+		if !ok {
+			continue
+		}
+
+		var valueNode yaml.Node
+		err := valueNode.Encode(yamlValue(value))
+		if err != nil {
+			return nil, err
+		}
+
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: column}, &valueNode)
+	}
+
+	return node, nil
+}
+
+// yamlValue converts the whole numbers in the value to integers, so they aren't written in exponent notation.
+func yamlValue(value any) any {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return int64(v)
+		}
+	case map[string]any:
+		converted := make(map[string]any, len(v))
+		for key, item := range v {
+			converted[key] = yamlValue(item)
+		}
+		return converted
+	case Entity:
+		return yamlValue(map[string]any(v))
+	case []any:
+		converted := make([]any, len(v))
+		for i, item := range v {
+			converted[i] = yamlValue(item)
+		}
+		return converted
+	case EntityCollection:
+		converted := make([]any, len(v))
+		for i, item := range v {
+			converted[i] = yamlValue(map[string]any(item))
+		}
+		return converted
+	}
+
+	return value
+}
+
+func encodeNDJSON(collection EntityCollection) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+
+	for _, entity := range collection {
+		err := encoder.Encode(entity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer.Bytes(), nil
+}
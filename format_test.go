@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format string
+	}{
+		{"", FormatJSON},
+		{"text/csv", FormatCSV},
+		{"*/*, text/csv", FormatCSV},
+		{"application/*, application/yaml", FormatYAML},
+		{"*/*, application/*;q=0.9", FormatJSON},
+		{"text/csv;q=0.5, application/xml", FormatXML},
+		{"application/x-ndjson;q=0.5, */*;q=0.8", FormatJSON},
+		{"text/html, text/csv", FormatJSON},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/user", nil)
+		r.Header.Set("Accept", test.accept)
+
+		format, ok := requestFormat(httptest.NewRecorder(), r)
+		if !ok || format != test.format {
+			t.Errorf("expected %s for Accept %q, got %s", test.format, test.accept, format)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/user", nil)
+	r.Header.Set("Accept", "image/png")
+	w := httptest.NewRecorder()
+	if _, ok := requestFormat(w, r); ok || w.Code != http.StatusNotAcceptable {
+		t.Errorf("expected 406 for an unsupported media type, got %d", w.Code)
+	}
+}
@@ -18,6 +18,7 @@ type Field struct {
 	Params   string `regroup:"params" json:"params"`
 	Required bool   `json:"required"`
 	Nullable bool   `json:"nullable"`
+	Children bool   `json:"children,omitempty"`
 }
 
 type FieldOptions struct {
@@ -36,6 +37,10 @@ func GenerateField(fieldName string, field string, table *Table, options FieldOp
 }
 
 func GenerateEntityField(field Field, table *Table) (any, *Table) {
+	if field.Type == "ref" {
+		return GenerateReference(field, table), table
+	}
+
 	gen := GetGenerator(field.Type, field.Subtype)
 	var paramStr string
 	var params []string
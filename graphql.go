@@ -0,0 +1,641 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/julienschmidt/httprouter"
+)
+
+const GraphQLPath = "/graphql"
+
+var graphQLNamePattern = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+var graphQLFilterOperators = []string{"ne", "gt", "gte", "lt", "lte"}
+
+var listMetadataType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "ListMetadata",
+	Fields: graphql.Fields{
+		"count": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+type graphQLBuilder struct {
+	objects map[string]*graphql.Object
+	filters map[string]*graphql.InputObject
+	inputs  map[string]*graphql.InputObject
+}
+
+// NewGraphQLSchema builds a schema with an object type, queries and mutations for every table.
+func NewGraphQLSchema(tables map[string]*Table) (graphql.Schema, error) {
+	builder := &graphQLBuilder{
+		objects: map[string]*graphql.Object{},
+		filters: map[string]*graphql.InputObject{},
+		inputs:  map[string]*graphql.InputObject{},
+	}
+
+	queries := graphql.Fields{}
+	mutations := graphql.Fields{}
+
+	for _, name := range sortedTableNames(tables) {
+		table := tables[name]
+		if !graphQLNamePattern.MatchString(table.Name) {
+			Warn("Table " + table.Name + " can't be used in GraphQL, its name isn't a valid GraphQL name")
+			continue
+		}
+
+		builder.objects[table.Name] = builder.object(table)
+		builder.filters[table.Name] = builder.filter(table)
+		builder.inputs[table.Name] = builder.input(table)
+	}
+
+	for _, name := range sortedTableNames(tables) {
+		table := tables[name]
+		object, ok := builder.objects[table.Name]
+		if !ok {
+			continue
+		}
+
+		typeName := schemaName(table)
+		filterArgs := graphql.FieldConfigArgument{
+			"filter": &graphql.ArgumentConfig{Type: builder.filters[table.Name]},
+		}
+
+		queries[table.Name] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, table.Name, http.MethodGet); err != nil {
+					return nil, err
+				}
+				table := ContextTable(p.Context, table)
+				entity, err := findOwnedGraphQL(p.Context, table, fmt.Sprint(p.Args["id"]))
+				if err != nil {
+					return nil, nil
+				}
+				return map[string]any(entity), nil
+			},
+		}
+
+		queries["all"+typeName] = &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(object))),
+			Args: graphql.FieldConfigArgument{
+				"filter": filterArgs["filter"],
+				"page":   &graphql.ArgumentConfig{Type: graphql.Int},
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+				"sort":   &graphql.ArgumentConfig{Type: graphql.String, Description: "Comma separated fields to sort by, prefixed with - for descending order"},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, table.Name, http.MethodGet); err != nil {
+					return nil, err
+				}
+				table := ContextTable(p.Context, table)
+				collection, err := graphQLCollection(table, p.Args, ContextCaller(p.Context).Owner(table).Scope()...)
+				if err != nil {
+					return nil, err
+				}
+				return graphQLList(collection), nil
+			},
+		}
+
+		queries["_all"+typeName+"Meta"] = &graphql.Field{
+			Type: listMetadataType,
+			Args: filterArgs,
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, table.Name, http.MethodGet); err != nil {
+					return nil, err
+				}
+				table := ContextTable(p.Context, table)
+				collection, err := graphQLCollection(table, map[string]any{"filter": p.Args["filter"]}, ContextCaller(p.Context).Owner(table).Scope()...)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]any{"count": len(collection)}, nil
+			},
+		}
+
+		mutations["create"+typeName] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(builder.inputs[table.Name])},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, table.Name, http.MethodPost); err != nil {
+					return nil, err
+				}
+				table := ContextTable(p.Context, table)
+				unlock := table.LockForWrite()
+				defer unlock()
+
+				data, _ := p.Args["input"].(map[string]any)
+				ContextCaller(p.Context).Owner(table).Apply(data, true)
+
+				entity, _, response := createEntityFromData(data, table)
+				if !response.Success {
+					return nil, errors.New(response.Message)
+				}
+
+				err := AppendTable(table, entity)
+				if err != nil {
+					return nil, err
+				}
+
+				return map[string]any(normalizeEntity(*entity)), nil
+			},
+		}
+
+		mutations["update"+typeName] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"id":    &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(builder.inputs[table.Name])},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				// Updates merge the input like PATCH, but also need whatever a PUT needs.
+				for _, method := range []string{http.MethodPut, http.MethodPatch} {
+					if err := Authorize(p.Context, table.Name, method); err != nil {
+						return nil, err
+					}
+				}
+				table := ContextTable(p.Context, table)
+				unlock := table.LockForWrite()
+				defer unlock()
+
+				id := fmt.Sprint(p.Args["id"])
+
+				existing, err := findOwnedGraphQL(p.Context, table, id)
+				if err != nil {
+					return nil, err
+				}
+
+				data := Entity(cloneObject(existing))
+				input, _ := p.Args["input"].(map[string]any)
+				for key, value := range input {
+					data[key] = value
+				}
+				ContextCaller(p.Context).Owner(table).Apply(data, false)
+
+				entity, response := updateEntityFromData(data, table, existing)
+				if !response.Success {
+					return nil, errors.New(response.Message)
+				}
+
+				err = UpdateById(table, id, entity)
+				if err != nil {
+					return nil, err
+				}
+
+				return map[string]any(normalizeEntity(*entity)), nil
+			},
+		}
+
+		mutations["delete"+typeName] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, table.Name, http.MethodDelete); err != nil {
+					return nil, err
+				}
+				table := ContextTable(p.Context, table)
+				unlock := table.Database().LockAll()
+				defer unlock()
+
+				id := fmt.Sprint(p.Args["id"])
+
+				existing, err := findOwnedGraphQL(p.Context, table, id)
+				if err != nil {
+					return nil, err
+				}
+
+				err = RemoveWithReferences(table, id)
+				if err != nil {
+					return nil, err
+				}
+
+				return map[string]any(existing), nil
+			},
+		}
+	}
+
+	if len(queries) == 0 {
+		return graphql.Schema{}, errors.New("no tables to build a GraphQL schema from")
+	}
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: queries}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutations}),
+	})
+}
+
+func (b *graphQLBuilder) object(table *Table) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: schemaName(table),
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{}
+
+			for _, key := range sortedKeys(table.Definition) {
+				field := table.Definition[key]
+				if !graphQLNamePattern.MatchString(key) {
+					continue
+				}
+
+				if field.Children {
+					child, ok := b.objects[field.ChildTable()]
+					if !ok {
+						continue
+					}
+					childTable := db.Tables[field.ChildTable()]
+					fields[key] = &graphql.Field{
+						Type: graphql.NewList(graphql.NewNonNull(child)),
+						Resolve: func(p graphql.ResolveParams) (any, error) {
+							if err := Authorize(p.Context, childTable.Name, http.MethodGet); err != nil {
+								return nil, err
+							}
+							source, _ := p.Source.(map[string]any)
+							childTable := ContextTable(p.Context, childTable)
+							children, err := FindChildren(childTable, table.Name, source["id"], ContextCaller(p.Context).Owner(childTable).Scope()...)
+							if err != nil {
+								return nil, err
+							}
+							return graphQLList(children), nil
+						},
+					}
+					continue
+				}
+
+				output := graphQLType(field)
+				if key == "id" {
+					output = graphql.NewNonNull(output)
+				}
+				fields[key] = &graphql.Field{Type: output}
+
+				if ref := field.Reference(); ref != nil {
+					b.addReferenceField(fields, table, key, ref)
+				}
+			}
+
+			return fields
+		}),
+	})
+}
+
+// addReferenceField adds a field resolving the entities a reference points to, named after the reference without its
+// `_id` suffix (or with an `_expanded` suffix if that's taken).
+func (b *graphQLBuilder) addReferenceField(fields graphql.Fields, table *Table, key string, ref *Reference) {
+	target, ok := b.objects[ref.Table]
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSuffix(strings.TrimSuffix(key, "_id"), "Id")
+	if _, taken := table.Definition[name]; taken || name == key || name == "" {
+		name = key + "_expanded"
+	}
+
+	targetTable := db.Tables[ref.Table]
+
+	if ref.Many {
+		fields[name] = &graphql.Field{
+			Type: graphql.NewList(graphql.NewNonNull(target)),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if err := Authorize(p.Context, targetTable.Name, http.MethodGet); err != nil {
+					return nil, err
+				}
+				source, _ := p.Source.(map[string]any)
+				ids, _ := source[key].([]any)
+				var entities []any
+				for _, id := range ids {
+					if entity, err := findOwnedGraphQL(p.Context, ContextTable(p.Context, targetTable), fmt.Sprint(id)); err == nil {
+						entities = append(entities, map[string]any(entity))
+					}
+				}
+				return entities, nil
+			},
+		}
+		return
+	}
+
+	fields[name] = &graphql.Field{
+		Type: target,
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			if err := Authorize(p.Context, targetTable.Name, http.MethodGet); err != nil {
+				return nil, err
+			}
+			source, _ := p.Source.(map[string]any)
+			if source[key] == nil {
+				return nil, nil
+			}
+			entity, err := findOwnedGraphQL(p.Context, ContextTable(p.Context, targetTable), fmt.Sprint(source[key]))
+			if err != nil {
+				return nil, nil
+			}
+			return map[string]any(entity), nil
+		},
+	}
+}
+
+// filter creates the input type for the filters of a table, using the same names as the query parameters of the REST
+// endpoints, e.g. `age_gte` or `name_like`.
+func (b *graphQLBuilder) filter(table *Table) *graphql.InputObject {
+	fields := graphql.InputObjectConfigFieldMap{}
+
+	for key, field := range table.Definition {
+		if field.Children || !graphQLNamePattern.MatchString(key) {
+			continue
+		}
+
+		scalar := graphQLScalar(field)
+
+		fields[key] = &graphql.InputObjectFieldConfig{Type: scalar}
+		for _, operator := range graphQLFilterOperators {
+			fields[key+"_"+operator] = &graphql.InputObjectFieldConfig{Type: scalar}
+		}
+		fields[key+"_like"] = &graphql.InputObjectFieldConfig{Type: graphql.String}
+		fields[key+"_in"] = &graphql.InputObjectFieldConfig{Type: graphql.NewList(scalar)}
+		fields[key+"_null"] = &graphql.InputObjectFieldConfig{Type: graphql.Boolean}
+	}
+
+	return graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:   schemaName(table) + "Filter",
+		Fields: fields,
+	})
+}
+
+func (b *graphQLBuilder) input(table *Table) *graphql.InputObject {
+	fields := graphql.InputObjectConfigFieldMap{}
+
+	for key, field := range table.Definition {
+		if field.Children || !graphQLNamePattern.MatchString(key) {
+			continue
+		}
+
+		fields[key] = &graphql.InputObjectFieldConfig{Type: graphQLType(field)}
+	}
+
+	return graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:   schemaName(table) + "Input",
+		Fields: fields,
+	})
+}
+
+// graphQLType maps the type of the field to a GraphQL type. GraphQL integers are 32-bit, so numbers are only exposed
+// as Int if their range fits.
+func graphQLType(field *Field) graphql.Type {
+	if ref := field.Reference(); ref != nil && ref.Many {
+		return graphql.NewList(graphQLScalar(field))
+	}
+
+	return graphQLScalar(field)
+}
+
+func graphQLScalar(field *Field) *graphql.Scalar {
+	params := strings.TrimPrefix(field.Params, ":")
+
+	switch field.Type {
+	case "id":
+		if field.Subtype == "uuid" {
+			return graphql.String
+		}
+		return graphql.Int
+	case "ref":
+		if table, ok := db.Tables[field.Reference().Table]; ok {
+			if id, ok := table.Definition["id"]; ok && id.Type == "id" {
+				return graphQLScalar(id)
+			}
+		}
+		return graphql.ID
+	case "number":
+		switch field.Subtype {
+		case "decimal":
+			return graphql.String
+		case "int":
+			if fitsInt32(params) {
+				return graphql.Int
+			}
+		}
+		return graphql.Float
+	case "date":
+		switch field.Subtype {
+		case "timestamp":
+			return graphql.Float
+		case "day", "year":
+			return graphql.Int
+		case "month":
+			if params != "string" {
+				return graphql.Int
+			}
+		}
+		return graphql.String
+	case "bool":
+		return graphql.Boolean
+	}
+
+	return graphql.String
+}
+
+func fitsInt32(params string) bool {
+	groups, err := NumberRangePattern.Groups(params)
+	if err != nil {
+		return false
+	}
+
+	lower, err := strconv.ParseFloat(groups["min"], 64)
+	if err != nil || lower < math.MinInt32 {
+		return false
+	}
+
+	upper, err := strconv.ParseFloat(groups["max"], 64)
+
+	return err == nil && upper <= math.MaxInt32
+}
+
+// graphQLCollection runs a list query through the same filters, sorting and pagination as the REST endpoints.
+func graphQLCollection(table *Table, args map[string]any, scope ...Filter) (EntityCollection, error) {
+	query := url.Values{}
+
+	if filter, ok := args["filter"].(map[string]any); ok {
+		for key, value := range filter {
+			if list, ok := value.([]any); ok {
+				parts := make([]string, len(list))
+				for i, item := range list {
+					parts[i] = fmt.Sprint(item)
+				}
+				query.Set(key, strings.Join(parts, ","))
+				continue
+			}
+			query.Set(key, fmt.Sprint(value))
+		}
+	}
+
+	if page, ok := args["page"].(int); ok {
+		query.Set("_page", strconv.Itoa(page))
+	}
+	if limit, ok := args["limit"].(int); ok {
+		query.Set("_limit", strconv.Itoa(limit))
+	}
+	if sort, ok := args["sort"].(string); ok {
+		query.Set("_sort", sort)
+	}
+
+	filters, err := ParseFilters(query, table)
+	if err != nil {
+		return nil, err
+	}
+
+	sorts, err := ParseSort(query, table)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := ParsePagination(query)
+	if err != nil {
+		return nil, err
+	}
+
+	collection, err := QueryTable(table, append(scope, filters...))
+	if err != nil {
+		return nil, err
+	}
+
+	collection = SortCollection(collection, sorts)
+
+	if page != nil {
+		collection = Paginate(collection, page).Items
+	}
+
+	return collection, nil
+}
+
+// findOwnedGraphQL returns the entity with the ID, failing like for a missing entity if it belongs to someone else.
+func findOwnedGraphQL(ctx context.Context, table *Table, id string) (Entity, error) {
+	entity, err := FindById(table, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ContextCaller(ctx).Owner(table).Owns(entity) {
+		return nil, errors.New("entity not found, id: " + id)
+	}
+
+	return entity, nil
+}
+
+// graphQLList converts the entities to plain maps, which the default resolvers of graphql-go know how to read.
+func graphQLList(collection EntityCollection) []any {
+	list := make([]any, len(collection))
+	for i, entity := range collection {
+		list[i] = map[string]any(entity)
+	}
+
+	return list
+}
+
+func sortedTableNames(tables map[string]*Table) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+func GraphQLHandler(schema graphql.Schema) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		var request graphQLRequest
+
+		if r.Method == http.MethodGet {
+			query := r.URL.Query()
+			if query.Get("query") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte(graphiQLPage))
+				return
+			}
+
+			request.Query = query.Get("query")
+			request.OperationName = query.Get("operationName")
+			if variables := query.Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &request.Variables); err != nil {
+					http.Error(w, "Invalid variables: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		} else {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if request.Query == "" {
+			http.Error(w, "Missing query", http.StatusBadRequest)
+			return
+		}
+
+		database, err := RequestDatabase(r)
+		if err != nil {
+			http.Error(w, "Unknown scenario: "+r.Header.Get(ScenarioHeader), http.StatusBadRequest)
+			return
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  request.Query,
+			VariableValues: request.Variables,
+			OperationName:  request.OperationName,
+			Context:        WithCaller(WithDatabase(r.Context(), database), RequestCaller(r)),
+		})
+
+		content, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		_, _ = w.Write(content)
+	}
+}
+
+const graphiQLPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>amock GraphQL</title>
+  <style>body { margin: 0; } #graphiql { height: 100dvh; }</style>
+  <link rel="stylesheet" href="https://unpkg.com/graphiql@3/graphiql.min.css">
+</head>
+<body>
+  <div id="graphiql"></div>
+  <script src="https://unpkg.com/react@18/umd/react.production.min.js" crossorigin></script>
+  <script src="https://unpkg.com/react-dom@18/umd/react-dom.production.min.js" crossorigin></script>
+  <script src="https://unpkg.com/graphiql@3/graphiql.min.js" crossorigin></script>
+  <script>
+    const fetcher = GraphiQL.createFetcher({ url: window.location.pathname });
+    ReactDOM.createRoot(document.getElementById("graphiql")).render(React.createElement(GraphiQL, { fetcher }));
+  </script>
+</body>
+</html>
+`
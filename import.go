@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OpenAPIImport translates the schemas of an OpenAPI (or Swagger 2) document into entity definitions.
+type OpenAPIImport struct {
+	schemas map[string]any
+	// tables maps component schema names to the table names they're served under.
+	tables   map[string]string
+	Entities map[string]EntityJSON
+	Warnings []string
+}
+
+var importStringNames = map[string]string{
+	"email":     "string.email",
+	"phone":     "string.phone",
+	"city":      "string.city",
+	"country":   "string.country",
+	"street":    "string.street",
+	"zip":       "string.zip",
+	"company":   "string.company",
+	"username":  "string.username",
+	"password":  "string.password",
+	"firstname": "string.firstname",
+	"lastname":  "string.lastname",
+	"name":      "string.name",
+	"url":       "string.url",
+	"color":     "string.color",
+	"title":     "string.sentence",
+	"content":   "string.paragraph",
+}
+
+var pathParameterPattern = regexp.MustCompile(`^\{.*}$`)
+
+func importCommand(args []string) error {
+	if len(args) < 2 || args[0] != "openapi" {
+		return errors.New("usage: amock import openapi <spec> [dir]")
+	}
+
+	dir := "entities"
+	if cfg, err := parseConfigFiles(ConfigPaths...); err == nil && cfg.Dir != "" {
+		dir = cfg.Dir
+	}
+	if len(args) > 2 {
+		dir = args[2]
+	}
+
+	imported, err := ImportOpenAPI(args[1])
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range imported.Warnings {
+		Warn(warning)
+	}
+
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(imported.Entities)) {
+		file := path.Join(dir, name+".json")
+
+		if _, err = os.Stat(file); err == nil {
+			Warn("Skipping " + file + ", the file already exists")
+			continue
+		}
+
+		b, err := json.MarshalIndent(imported.Entities[name], "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(file, append(b, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+
+		println("Created " + file)
+	}
+
+	return nil
+}
+
+func ImportOpenAPI(file string) (*OpenAPIImport, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file %s: %w", file, err)
+	}
+
+	var document map[string]any
+
+	// YAML is a superset of JSON, so this handles both formats.
+	err = yaml.Unmarshal(raw, &document)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse file %s: %w", file, err)
+	}
+
+	document, _ = normalizeYAML(document).(map[string]any)
+
+	imported := &OpenAPIImport{
+		schemas:  map[string]any{},
+		tables:   map[string]string{},
+		Entities: map[string]EntityJSON{},
+	}
+
+	if components, ok := document["components"].(map[string]any); ok {
+		if schemas, ok := components["schemas"].(map[string]any); ok {
+			imported.schemas = schemas
+		}
+	} else if definitions, ok := document["definitions"].(map[string]any); ok {
+		imported.schemas = definitions
+	}
+
+	if len(imported.schemas) == 0 {
+		return nil, errors.New("no schemas found in " + file)
+	}
+
+	paths, _ := document["paths"].(map[string]any)
+	for _, route := range slices.Sorted(maps.Keys(paths)) {
+		imported.importPath(route, paths[route])
+	}
+
+	// A document without usable paths still describes the entities.
+	if len(imported.tables) == 0 {
+		for name, schema := range imported.schemas {
+			if imported.isObject(schema) {
+				imported.tables[name] = strings.ToLower(name)
+			}
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(imported.tables)) {
+		imported.Entities[imported.tables[name]] = imported.entity(name)
+	}
+
+	return imported, nil
+}
+
+// importPath registers the table served at the first segment of the path, using the schema its operations return
+// or accept.
+func (i *OpenAPIImport) importPath(route string, item any) {
+	segments := strings.Split(strings.Trim(route, "/"), "/")
+	if len(segments) == 0 || segments[0] == "" || pathParameterPattern.MatchString(segments[0]) {
+		return
+	}
+
+	// Nested routes like /users/{id}/posts describe another table, which has its own top-level route.
+	if len(segments) > 2 {
+		return
+	}
+
+	table := strings.ToLower(segments[0])
+
+	operations, ok := item.(map[string]any)
+	if !ok {
+		return
+	}
+
+	for _, method := range []string{"get", "post", "put", "patch"} {
+		operation, ok := operations[method].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if name := i.operationSchema(operation); name != "" {
+			if _, exists := i.tables[name]; !exists {
+				i.tables[name] = table
+			}
+			return
+		}
+	}
+}
+
+// normalizeYAML converts the mappings of a decoded YAML document to map[string]any. Mappings with keys that aren't
+// strings, like unquoted status codes, are decoded to map[any]any otherwise.
+func normalizeYAML(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeYAML(item)
+		}
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, item := range v {
+			converted[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return converted
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+	}
+
+	return value
+}
+
+func (i *OpenAPIImport) operationSchema(operation map[string]any) string {
+	var candidates []any
+
+	if responses, ok := operation["responses"].(map[string]any); ok {
+		for _, code := range slices.Sorted(maps.Keys(responses)) {
+			if strings.HasPrefix(code, "2") {
+				candidates = append(candidates, responses[code])
+			}
+		}
+	}
+
+	candidates = append(candidates, operation["requestBody"])
+
+	// Swagger 2 declares request bodies as parameters.
+	if parameters, ok := operation["parameters"].([]any); ok {
+		for _, parameter := range parameters {
+			if p, ok := parameter.(map[string]any); ok && p["in"] == "body" {
+				candidates = append(candidates, p)
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		object, ok := candidate.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		for _, schema := range bodySchemas(object) {
+			if name := i.schemaName(schema); name != "" {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+func bodySchemas(object map[string]any) []any {
+	var schemas []any
+
+	if schema, ok := object["schema"]; ok {
+		schemas = append(schemas, schema)
+	}
+
+	if content, ok := object["content"].(map[string]any); ok {
+		for _, mediaType := range slices.Sorted(maps.Keys(content)) {
+			if m, ok := content[mediaType].(map[string]any); ok && strings.Contains(mediaType, "json") {
+				schemas = append(schemas, m["schema"])
+			}
+		}
+	}
+
+	return schemas
+}
+
+// schemaName returns the name of the component an object schema refers to, looking into arrays and common envelopes.
+func (i *OpenAPIImport) schemaName(schema any) string {
+	object, ok := schema.(map[string]any)
+	if !ok {
+		return ""
+	}
+
+	if name := refName(object); name != "" {
+		if i.isObject(i.schemas[name]) {
+			return name
+		}
+		return i.schemaName(i.schemas[name])
+	}
+
+	if items, ok := object["items"]; ok {
+		return i.schemaName(items)
+	}
+
+	for _, key := range []string{"allOf", "oneOf", "anyOf"} {
+		if list, ok := object[key].([]any); ok {
+			for _, item := range list {
+				if name := i.schemaName(item); name != "" {
+					return name
+				}
+			}
+		}
+	}
+
+	if properties, ok := object["properties"].(map[string]any); ok {
+		for _, key := range []string{"items", "data", "results"} {
+			if name := i.schemaName(properties[key]); name != "" {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+func (i *OpenAPIImport) isObject(schema any) bool {
+	object, ok := schema.(map[string]any)
+	if !ok {
+		return false
+	}
+
+	_, hasProperties := object["properties"]
+
+	return object["type"] == "object" || hasProperties || object["allOf"] != nil
+}
+
+func (i *OpenAPIImport) entity(name string) EntityJSON {
+	entity := EntityJSON{}
+	properties, required := i.properties(i.schemas[name], 0)
+
+	for _, key := range slices.Sorted(maps.Keys(properties)) {
+		property, _ := properties[key].(map[string]any)
+
+		value, ok := i.fieldType(key, property, 0)
+		if !ok {
+			i.Warnings = append(i.Warnings, fmt.Sprintf("Skipping property %s.%s, it can't be mapped to an amock type", name, key))
+			continue
+		}
+
+		switch {
+		case slices.Contains(required, key) && key != "id":
+			key += "!"
+		case isNullable(property):
+			key += "?"
+		}
+
+		entity[key] = value
+	}
+
+	if _, ok := entity["id"]; !ok {
+		entity["id"] = "id.sequence"
+	}
+
+	return entity
+}
+
+// properties collects the properties and required fields of an object schema, merging the schemas listed in allOf.
+func (i *OpenAPIImport) properties(schema any, depth int) (map[string]any, []string) {
+	object, ok := schema.(map[string]any)
+	if !ok || depth > 10 {
+		return nil, nil
+	}
+
+	if name := refName(object); name != "" {
+		return i.properties(i.schemas[name], depth+1)
+	}
+
+	properties := map[string]any{}
+	var required []string
+
+	if list, ok := object["allOf"].([]any); ok {
+		for _, item := range list {
+			p, r := i.properties(item, depth+1)
+			for key, value := range p {
+				properties[key] = value
+			}
+			required = append(required, r...)
+		}
+	}
+
+	if p, ok := object["properties"].(map[string]any); ok {
+		for key, value := range p {
+			properties[key] = value
+		}
+	}
+
+	if r, ok := object["required"].([]any); ok {
+		for _, key := range r {
+			if s, ok := key.(string); ok {
+				required = append(required, s)
+			}
+		}
+	}
+
+	return properties, required
+}
+
+// fieldType maps the schema of a property to the `type.subtype:params` format of entity files. Properties whose
+// references are nested too deeply, like circular ones, become strings.
+func (i *OpenAPIImport) fieldType(key string, property map[string]any, depth int) (string, bool) {
+	if property == nil {
+		return "", false
+	}
+
+	if depth > 10 {
+		i.Warnings = append(i.Warnings, fmt.Sprintf("Property %s has circular or too deeply nested references, using string", key))
+		return "string", true
+	}
+
+	if name := refName(property); name != "" {
+		if table, ok := i.tables[name]; ok {
+			return "ref:" + table, true
+		}
+		resolved, _ := i.schemas[name].(map[string]any)
+		return i.fieldType(key, resolved, depth+1)
+	}
+
+	// Documents written by amock describe references this way.
+	if description, ok := property["description"].(string); ok && strings.HasPrefix(description, "References ") {
+		table := strings.TrimPrefix(description, "References ")
+		if slices.Contains(slices.Collect(maps.Values(i.tables)), table) {
+			if schemaType(property) == "array" {
+				return "ref:" + table + "[]", true
+			}
+			return "ref:" + table, true
+		}
+	}
+
+	if list, ok := property["allOf"].([]any); ok && len(list) == 1 {
+		item, _ := list[0].(map[string]any)
+		return i.fieldType(key, item, depth+1)
+	}
+
+	if values, ok := property["enum"].([]any); ok && len(values) > 0 {
+		options := make([]string, 0, len(values))
+		for _, value := range values {
+			if value != nil {
+				options = append(options, fmt.Sprint(value))
+			}
+		}
+		return "enum:" + strings.Join(options, ","), true
+	}
+
+	format, _ := property["format"].(string)
+
+	switch schemaType(property) {
+	case "string":
+		if key == "id" {
+			return "id.uuid", true
+		}
+		switch format {
+		case "uuid":
+			return "id.uuid", true
+		case "email":
+			return "string.email", true
+		case "uri", "url":
+			return "string.url", true
+		case "ipv4":
+			return "string.ip", true
+		case "ipv6":
+			return "string.ipv6", true
+		case "password":
+			return "string.password", true
+		case "date":
+			return "date:yyyy-MM-dd", true
+		case "date-time":
+			return "date", true
+		}
+		normalized := strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(key, "_", ""), "-", ""))
+		if value, ok := importStringNames[normalized]; ok {
+			return value, true
+		}
+		return "string", true
+	case "integer":
+		if key == "id" {
+			return "id.sequence", true
+		}
+		if table := i.foreignKeyTable(key); table != "" {
+			return "ref:" + table, true
+		}
+		if format == "unix-time" || format == "timestamp" {
+			return "date.timestamp", true
+		}
+		if r := numberBounds(property); r != "" {
+			return "number.int:" + r, true
+		}
+		return "number", true
+	case "number":
+		if r := numberBounds(property); r != "" {
+			return "number.range:" + r, true
+		}
+		return "number.float", true
+	case "boolean":
+		return "bool", true
+	case "array":
+		items, _ := property["items"].(map[string]any)
+		if name := refName(items); name != "" {
+			if table, ok := i.tables[name]; ok {
+				return "ref:" + table + "[]", true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// foreignKeyTable returns the table an integer property like `user_id` or `userId` points to, if there's one.
+func (i *OpenAPIImport) foreignKeyTable(key string) string {
+	var base string
+	switch {
+	case strings.HasSuffix(key, "_id"):
+		base = strings.TrimSuffix(key, "_id")
+	case strings.HasSuffix(key, "Id"):
+		base = strings.TrimSuffix(key, "Id")
+	default:
+		return ""
+	}
+
+	base = strings.ToLower(base)
+
+	for _, table := range i.tables {
+		if table == base || table == base+"s" || table == base+"es" {
+			return table
+		}
+	}
+
+	return ""
+}
+
+func refName(object map[string]any) string {
+	ref, ok := object["$ref"].(string)
+	if !ok {
+		return ""
+	}
+
+	return ref[strings.LastIndex(ref, "/")+1:]
+}
+
+// schemaType returns the type of the schema, ignoring "null" in OpenAPI 3.1 type lists.
+func schemaType(property map[string]any) string {
+	switch t := property["type"].(type) {
+	case string:
+		return t
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok && s != "null" {
+				return s
+			}
+		}
+	}
+
+	return ""
+}
+
+func isNullable(property map[string]any) bool {
+	if nullable, ok := property["nullable"].(bool); ok && nullable {
+		return true
+	}
+
+	if list, ok := property["type"].([]any); ok {
+		return slices.Contains(list, any("null"))
+	}
+
+	return false
+}
+
+func numberBounds(property map[string]any) string {
+	bound := func(key string) string {
+		switch n := property[key].(type) {
+		case int:
+			return strconv.Itoa(n)
+		case float64:
+			return strconv.FormatFloat(n, 'f', -1, 64)
+		}
+		return "x"
+	}
+
+	lower, upper := bound("minimum"), bound("maximum")
+	if lower == "x" && upper == "x" {
+		return ""
+	}
+
+	return lower + "-" + upper
+}
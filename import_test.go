@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+func TestImportOpenAPICircularReferences(t *testing.T) {
+	file := path.Join(t.TempDir(), "openapi.yaml")
+	err := os.WriteFile(file, []byte(`
+openapi: 3.0.0
+components:
+  schemas:
+    A:
+      $ref: '#/components/schemas/B'
+    B:
+      $ref: '#/components/schemas/A'
+    Pet:
+      type: object
+      properties:
+        id:
+          type: integer
+        owner:
+          $ref: '#/components/schemas/A'
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, err := ImportOpenAPI(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner := imported.Entities["pet"]["owner"]; owner != "string" {
+		t.Errorf("expected the circular reference to become a string, got %q", owner)
+	}
+	if len(imported.Warnings) == 0 {
+		t.Error("expected a warning about the circular reference")
+	}
+}
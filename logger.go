@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"log"
 	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"time"
@@ -20,6 +22,18 @@ func (sr *StatusRecorder) WriteHeader(status int) {
 	sr.ResponseWriter.WriteHeader(status)
 }
 
+func (sr *StatusRecorder) Flush() {
+	_ = http.NewResponseController(sr.ResponseWriter).Flush()
+}
+
+func (sr *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(sr.ResponseWriter).Hijack()
+}
+
+func (sr *StatusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 var LogLevel = new(slog.LevelVar)
 
 func Warn(msg string, args ...any) {
@@ -8,10 +8,13 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/tabwriter"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/jwalton/gchalk"
@@ -36,20 +39,34 @@ var SchemaDir = path.Join(".amock", "schema")
 var TablesDir = path.Join(".amock", "tables")
 
 type Config struct {
-	Host      string   `yaml:"host" env:"AMOCK_HOST" env-default:"localhost"`
-	Port      int      `yaml:"port" env:"AMOCK_PORT" env-default:"8080"`
-	Dir       string   `yaml:"dir" env:"AMOCK_DIR"`
-	Entities  []string `yaml:"entities" env:"AMOCK_ENTITIES"`
-	InitCount int      `yaml:"initCount" env:"AMOCK_INIT_COUNT" env-default:"20"`
+	Host            string                    `yaml:"host" env:"AMOCK_HOST" env-default:"localhost"`
+	Port            int                       `yaml:"port" env:"AMOCK_PORT" env-default:"8080"`
+	Dir             string                    `yaml:"dir" env:"AMOCK_DIR"`
+	Entities        []string                  `yaml:"entities" env:"AMOCK_ENTITIES"`
+	InitCount       int                       `yaml:"initCount" env:"AMOCK_INIT_COUNT" env-default:"20"`
+	Pagination      string                    `yaml:"pagination" env:"AMOCK_PAGINATION" env-default:"headers"`
+	PageSize        int                       `yaml:"pageSize" env:"AMOCK_PAGE_SIZE" env-default:"10"`
+	FlushDelay      int                       `yaml:"flushDelay" env:"AMOCK_FLUSH_DELAY" env-default:"200"`
+	Storage         string                    `yaml:"storage" env:"AMOCK_STORAGE" env-default:"json"`
+	SQLiteFile      string                    `yaml:"sqliteFile" env:"AMOCK_SQLITE_FILE" env-default:".amock/amock.db"`
+	GraphQL         bool                      `yaml:"graphql" env:"AMOCK_GRAPHQL"`
+	SyntheticEvents int                       `yaml:"syntheticEvents" env:"AMOCK_SYNTHETIC_EVENTS"`
+	Webhooks        []WebhookConfig           `yaml:"webhooks"`
+	AdminToken      string                    `yaml:"adminToken" env:"AMOCK_ADMIN_TOKEN"`
+	Scenarios       map[string]ScenarioConfig `yaml:"scenarios"`
+	SessionTimeout  int                       `yaml:"sessionTimeout" env:"AMOCK_SESSION_TIMEOUT" env-default:"1800"`
+	Chaos           ChaosSettings             `yaml:"chaos"`
+	Auth            AuthConfig                `yaml:"auth"`
+	Ownership       OwnershipConfig           `yaml:"ownership"`
+	RequireIfMatch  bool                      `yaml:"requireIfMatch" env:"AMOCK_REQUIRE_IF_MATCH"`
 }
 
 var config *Config
 
 var db Database
 
-func init() {
-	parseFlags()
-
+// initDatabase loads the config and builds the database from the entity files.
+func initDatabase() {
 	Debug("Creating database from config...")
 
 	config, _ = parseConfigFiles(ConfigPaths...)
@@ -78,13 +95,34 @@ func init() {
 		}
 	}
 
+	storage, err := NewStorage(config.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db.Storage = storage
+
 	Debug("Database created")
 
-	db = *HydrateDatabase(&db)
+	HydrateDatabase(&db)
+
+	err = RecordSeeds(&db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = BuildScenarios(config.Scenarios)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getHostFromArgs() {
 	host := flag.Arg(0)
+	if _, ok := Commands[host]; ok {
+		return
+	}
+
 	if host != "" {
 		var noPrefix string
 		var prefix string
@@ -113,6 +151,17 @@ func getHostFromArgs() {
 }
 
 func main() {
+	parseFlags()
+
+	if command, ok := Commands[flag.Arg(0)]; ok {
+		err := command(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	initDatabase()
 	StartServer()
 }
 
@@ -142,8 +191,39 @@ func StartServer() {
 		}
 	}
 	fmt.Println("")
+	fmt.Println("API documentation: " + gchalk.Bold(url+DocsPath) + gchalk.Dim(" (OpenAPI document at "+url+OpenAPIPath+")"))
+	if config.GraphQL {
+		fmt.Println("GraphQL endpoint: " + gchalk.Bold(url+GraphQLPath))
+	}
+	if auth != nil {
+		fmt.Println("Login endpoint: " + gchalk.Bold(url+auth.config.Path+"/login") + gchalk.Dim(" (users from table "+auth.config.Table+")"))
+	}
+	if oidc != nil {
+		fmt.Println("OpenID Connect issuer: " + gchalk.Bold(oidc.issuer) + gchalk.Dim(" (discovery at "+oidc.issuer+"/.well-known/openid-configuration)"))
+	}
+	fmt.Println("")
+
+	if len(config.Webhooks) > 0 {
+		webhooks = StartWebhooks(Events, config.Webhooks)
+	}
+	StartSyntheticEvents(time.Duration(config.SyntheticEvents) * time.Millisecond)
+	StartSessionCollector(time.Duration(config.SessionTimeout) * time.Second)
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		_ = FlushTables()
+		_ = db.Storage.Close()
+		os.Exit(0)
+	}()
+
+	err := http.ListenAndServe(config.Host+":"+strconv.Itoa(config.Port), LogRequest(Chaos(Authenticate(router))))
 
-	log.Fatal(http.ListenAndServe(config.Host+":"+strconv.Itoa(config.Port), LogRequest(router)))
+	_ = FlushTables()
+	_ = db.Storage.Close()
+	log.Fatal(err)
 }
 
 func parseConfigFiles(files ...string) (*Config, error) {
@@ -180,7 +260,7 @@ func buildTablesFromConfig() {
 		}
 	}
 
-	db.Tables = make(map[string]Table)
+	db.Tables = make(map[string]*Table)
 
 	if config.Dir != "" {
 		dir, err := os.ReadDir(config.Dir)
@@ -193,25 +273,25 @@ func buildTablesFromConfig() {
 			filename := entry.Name()
 			table, name := getOrCreateTable(filename, path.Join(config.Dir, filename))
 			Debug("Table "+gchalk.Bold(name)+" created from file "+gchalk.Bold(filename), "table", name, "file", filename)
-			db.Tables[name] = *table
+			db.Tables[name] = table
 		}
 	}
 
 	if len(config.Entities) > 0 {
 		for _, entity := range config.Entities {
 			table, name := getOrCreateTable(entity, entity)
-			db.Tables[name] = *table
+			db.Tables[name] = table
 		}
 	}
 }
 
 func getOrCreateTable(filename string, definitionFile string) (*Table, string) {
 	createNew := false
-	tempTable := Table{}
+	tempTable := &Table{}
 	var name string
 
 	if path.Ext(filename) == ".json" {
-		tableFilePath := path.Join(TablesDir, filename+".table")
+		tableFilePath := path.Join(TablesDir, path.Base(filename)+".table")
 		name = strings.ToLower(filename[:len(filename)-5])
 
 		if _, err := os.Stat(tableFilePath); errors.Is(err, os.ErrNotExist) {
@@ -224,7 +304,7 @@ func getOrCreateTable(filename string, definitionFile string) (*Table, string) {
 
 			Debug("Table "+gchalk.Bold(name)+" found at "+gchalk.Italic(tableFilePath)+" - skipping...", "table", name, "file", tableFilePath)
 
-			err = json.Unmarshal(tableFile, &tempTable)
+			err = json.Unmarshal(tableFile, tempTable)
 			if err != nil {
 				createNew = true
 			}
@@ -233,13 +313,16 @@ func getOrCreateTable(filename string, definitionFile string) (*Table, string) {
 
 	if createNew {
 		tempTable = createNewTable(name, filename, definitionFile)
+	} else if name != "" {
+		tempTable.Name = name
+		tempTable.DefinitionFile = definitionFile
 	}
 
-	return &tempTable, name
+	return tempTable, name
 }
 
-func createNewTable(name string, filename string, definitionFile string) Table {
-	return Table{
+func createNewTable(name string, filename string, definitionFile string) *Table {
+	return &Table{
 		Name:           name,
 		DefinitionFile: definitionFile,
 		Definition:     make(map[string]*Field),
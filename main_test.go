@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+var testEntities = map[string]string{
+	"user.json": `{"id": "id.sequence", "name!": "string.firstname", "email": "string.email", "posts[]": "post.json"}`,
+	"post.json": `{"id": "id.sequence", "user_id": "ref:user,cascade", "title!": "string.sentence"}`,
+}
+
+// newTestServer builds the database from the entity files in a temporary directory, like the server does on start,
+// and returns the handler of the server.
+func newTestServer(t *testing.T, cfg Config, entities map[string]string) http.Handler {
+	t.Helper()
+	t.Chdir(t.TempDir())
+
+	err := os.MkdirAll("entities", os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, definition := range entities {
+		err = os.WriteFile(path.Join("entities", name), []byte(definition), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.MkdirAll(TablesDir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Dir = "entities"
+	cfg.Storage = StorageMemory
+	if cfg.Host == "" {
+		cfg.Host = "localhost"
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8080
+	}
+	if cfg.InitCount == 0 {
+		cfg.InitCount = 5
+	}
+	if cfg.PageSize == 0 {
+		cfg.PageSize = 10
+	}
+	if cfg.FlushDelay == 0 {
+		cfg.FlushDelay = 10
+	}
+	config = &cfg
+
+	db = Database{}
+	auth, oidc, webhooks = nil, nil, nil
+	Events = NewEventBus()
+	Routes = nil
+
+	buildTablesFromConfig()
+	db.Storage = NewMemoryStorage()
+	HydrateDatabase(&db)
+
+	err = RecordSeeds(&db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the pending metadata before the directory is removed, so it doesn't end up in the next test's directory.
+	t.Cleanup(func() { _ = FlushTables() })
+
+	return Authenticate(InitHandlers(config, &db))
+}
+
+// request sends a request with the JSON body, if any, and returns the response with its body read.
+func request(t *testing.T, method string, url string, body any, headers ...string) (*http.Response, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, content
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jwalton/gchalk"
+)
+
+// Migration describes the changes between the stored schema of a table and its entity file.
+type Migration struct {
+	Table       string
+	Added       []string
+	Removed     []string
+	Changed     []string
+	Rows        int
+	Regenerated int
+}
+
+func (m Migration) Empty() bool {
+	return len(m.Added) == 0 && len(m.Removed) == 0 && len(m.Changed) == 0
+}
+
+func (m Migration) String() string {
+	var changes []string
+
+	if len(m.Added) > 0 {
+		changes = append(changes, "added "+strings.Join(m.Added, ", "))
+	}
+	if len(m.Removed) > 0 {
+		changes = append(changes, "removed "+strings.Join(m.Removed, ", "))
+	}
+	if len(m.Changed) > 0 {
+		changes = append(changes, "changed "+strings.Join(m.Changed, ", "))
+	}
+
+	return gchalk.Bold("Migrated table "+m.Table) + ": " + strings.Join(changes, "; ") +
+		gchalk.Dim(" ("+strconv.Itoa(m.Rows)+" rows updated, "+strconv.Itoa(m.Regenerated)+" values generated)")
+}
+
+// ParseDefinition returns the field definitions of an entity file without generating any data.
+func ParseDefinition(entityJSON EntityJSON) map[string]*Field {
+	definition := make(map[string]*Field, len(entityJSON))
+
+	for key, value := range entityJSON {
+		fieldName, options := ParseFieldKey(key)
+
+		if options.Children {
+			definition[fieldName] = ChildrenField(value)
+			continue
+		}
+
+		field := GetFieldType(value)
+		field.Required = options.Required
+		field.Nullable = options.Nullable
+		definition[fieldName] = field
+	}
+
+	return definition
+}
+
+// MigrateTable updates the rows of the table to match its entity file. Values are generated for added fields, removed
+// fields are dropped and values of changed fields are generated again if they aren't valid anymore.
+func MigrateTable(table *Table, stored map[string]*Field, entityJSON EntityJSON) (Migration, error) {
+	definition := ParseDefinition(entityJSON)
+	migration := Migration{Table: table.Name}
+
+	for key, field := range definition {
+		old, ok := stored[key]
+		if !ok {
+			migration.Added = append(migration.Added, key)
+		} else if *old != *field {
+			migration.Changed = append(migration.Changed, key)
+		}
+	}
+
+	for key := range stored {
+		if _, ok := definition[key]; !ok {
+			migration.Removed = append(migration.Removed, key)
+		}
+	}
+
+	slices.Sort(migration.Added)
+	slices.Sort(migration.Removed)
+	slices.Sort(migration.Changed)
+
+	table.Definition = definition
+
+	if migration.Empty() {
+		return migration, nil
+	}
+
+	collection, err := ReadTable(table)
+	if err != nil {
+		return migration, err
+	}
+
+	for _, entity := range collection {
+		changed := false
+
+		for _, key := range migration.Removed {
+			if _, ok := entity[key]; ok {
+				delete(entity, key)
+				changed = true
+			}
+		}
+
+		for _, key := range append(slices.Clone(migration.Added), migration.Changed...) {
+			field := definition[key]
+			if field.Children {
+				continue
+			}
+
+			if value, ok := entity[key]; ok && keepValue(table, key, field, stored[key], value) {
+				continue
+			}
+
+			entity[key], table = GenerateEntityField(*field, table)
+			migration.Regenerated++
+			changed = true
+		}
+
+		if changed {
+			migration.Rows++
+		}
+	}
+
+	err = table.Database().Storage.SaveSchema(table)
+	if err != nil {
+		return migration, err
+	}
+
+	err = table.Database().Storage.Replace(table, collection)
+	if err != nil {
+		return migration, err
+	}
+
+	return migration, nil
+}
+
+// keepValue reports whether the existing value is still valid for the changed field.
+func keepValue(table *Table, key string, field *Field, old *Field, value any) bool {
+	if old == nil || old.Children {
+		return false
+	}
+
+	if field.Type == "id" {
+		return old.Type == field.Type && old.Subtype == field.Subtype
+	}
+
+	return ValidateField(field, value, key, table).Valid
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestMigrateTableChangesFieldType(t *testing.T) {
+	newTestServer(t, Config{}, map[string]string{
+		"user.json": `{"id": "id.sequence", "name": "string.firstname", "age": "number.int:18-64"}`,
+	})
+
+	table := db.Tables["user"]
+	stored := maps.Clone(table.Definition)
+
+	before, err := ReadTable(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migration, err := MigrateTable(table, stored, EntityJSON{
+		"id":   "id.sequence",
+		"name": "string.lastname",
+		"age":  "string.firstname",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if migration.Regenerated != len(before) {
+		t.Errorf("expected the %d ages to be generated again, got %d values", len(before), migration.Regenerated)
+	}
+
+	after, err := ReadTable(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, user := range after {
+		if _, ok := user["age"].(string); !ok {
+			t.Errorf("expected the age to be a string after the migration, got %v", user["age"])
+		}
+		if user["name"] != before[i]["name"] {
+			t.Errorf("expected the name %v to be kept, got %v", before[i]["name"], user["name"])
+		}
+	}
+}
+
+func TestValidateFieldChecksNumbers(t *testing.T) {
+	tests := []struct {
+		field *Field
+		value any
+		valid bool
+	}{
+		{&Field{Type: "number"}, 3.0, true},
+		{&Field{Type: "date", Subtype: "timestamp"}, 1700000000.0, true},
+		{&Field{Type: "string"}, 3.0, false},
+		{&Field{Type: "bool"}, 1, false},
+		{&Field{Type: "date"}, 3.0, false},
+	}
+
+	for _, test := range tests {
+		result := ValidateField(test.field, test.value, "field", &Table{Name: "test"})
+		if result.Valid != test.valid {
+			t.Errorf("expected the validity of %v for a %s field to be %v", test.value, test.field.Type, test.valid)
+		}
+	}
+}
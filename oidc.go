@@ -0,0 +1,696 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const OIDCCookie = "amock_oidc"
+
+// OIDCConfig turns the auth table into a local OpenID Connect provider.
+type OIDCConfig struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Issuer  string `yaml:"issuer" json:"issuer"`
+	// KeyFile stores the key signing the ID tokens, so they stay valid after a restart.
+	KeyFile string       `yaml:"keyFile" json:"keyFile"`
+	Clients []OIDCClient `yaml:"clients" json:"clients"`
+	// Claims maps the claims of the ID tokens and userinfo to the fields of the users.
+	Claims map[string]string `yaml:"claims" json:"claims"`
+}
+
+// OIDCClient is a registered client. Without any registered clients, every client ID and redirect URI is accepted.
+type OIDCClient struct {
+	Id                     string   `yaml:"id" json:"id"`
+	Secret                 string   `yaml:"secret" json:"secret"`
+	RedirectUris           []string `yaml:"redirectUris" json:"redirectUris"`
+	PostLogoutRedirectUris []string `yaml:"postLogoutRedirectUris" json:"postLogoutRedirectUris"`
+}
+
+type authorizationCode struct {
+	clientId      string
+	redirectUri   string
+	challenge     string
+	method        string
+	nonce         string
+	scope         string
+	user          Entity
+	authenticated time.Time
+	expires       time.Time
+}
+
+type oidcLogin struct {
+	user          Entity
+	authenticated time.Time
+}
+
+type OIDC struct {
+	mu     sync.Mutex
+	config OIDCConfig
+	issuer string
+	key    *rsa.PrivateKey
+	keyId  string
+	codes  map[string]authorizationCode
+	logins map[string]oidcLogin
+}
+
+var oidc *OIDC
+
+func NewOIDC(cfg OIDCConfig, issuer string) (*OIDC, error) {
+	if cfg.Issuer != "" {
+		issuer = cfg.Issuer
+	}
+	if cfg.KeyFile == "" {
+		cfg.KeyFile = path.Join(".amock", "oidc.key")
+	}
+	if len(cfg.Claims) == 0 {
+		cfg.Claims = map[string]string{
+			"name":               "name",
+			"email":              "email",
+			"preferred_username": auth.config.UsernameField,
+			"role":               auth.config.RoleField,
+		}
+	}
+
+	key, err := loadSigningKey(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(key.N.Bytes())
+
+	return &OIDC{
+		config: cfg,
+		issuer: strings.TrimSuffix(issuer, "/"),
+		key:    key,
+		keyId:  hex.EncodeToString(fingerprint[:8]),
+		codes:  map[string]authorizationCode{},
+		logins: map[string]oidcLogin{},
+	}, nil
+}
+
+// loadSigningKey reads the RSA key from the file, generating it first if the file doesn't exist.
+func loadSigningKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("invalid key file " + file)
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file %s: %w", file, err)
+		}
+
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("key file " + file + " doesn't contain an RSA key")
+		}
+
+		return rsaKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	Debug("Generating OIDC signing key", "file", file)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(path.Dir(file), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// client returns the registered client with the ID. Any client is public when no clients are registered.
+func (o *OIDC) client(id string) (OIDCClient, bool) {
+	if len(o.config.Clients) == 0 {
+		return OIDCClient{Id: id}, id != ""
+	}
+
+	for _, client := range o.config.Clients {
+		if client.Id == id {
+			return client, true
+		}
+	}
+
+	return OIDCClient{}, false
+}
+
+func (o *OIDC) allowsRedirect(allowed []string, uri string) bool {
+	if len(o.config.Clients) == 0 {
+		parsed, err := url.Parse(uri)
+		return err == nil && parsed.IsAbs()
+	}
+
+	return slices.Contains(allowed, uri)
+}
+
+// Claims returns the claims of the user, mapped from its fields.
+func (o *OIDC) Claims(user Entity) map[string]any {
+	claims := map[string]any{"sub": fmt.Sprint(user["id"])}
+
+	for claim, field := range o.config.Claims {
+		if value, ok := user[field]; ok && value != nil {
+			claims[claim] = value
+		}
+	}
+
+	return claims
+}
+
+func (o *OIDC) IdToken(user Entity, clientId string, nonce string, authenticated time.Time) (string, error) {
+	now := time.Now()
+
+	claims := o.Claims(user)
+	claims["iss"] = o.issuer
+	claims["aud"] = clientId
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(auth.config.Expiry) * time.Second).Unix()
+	claims["auth_time"] = authenticated.Unix()
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": o.keyId})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, o.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (o *OIDC) IssueCode(code authorizationCode) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	now := time.Now()
+	for id, stored := range o.codes {
+		if now.After(stored.expires) {
+			delete(o.codes, id)
+		}
+	}
+
+	id := randomToken()
+	code.expires = now.Add(time.Minute)
+	o.codes[id] = code
+
+	return id
+}
+
+// RedeemCode returns the authorization code. Every code can be redeemed only once.
+func (o *OIDC) RedeemCode(id string) (authorizationCode, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	code, ok := o.codes[id]
+	delete(o.codes, id)
+
+	return code, ok && time.Now().Before(code.expires)
+}
+
+func (o *OIDC) Login(user Entity) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	id := randomToken()
+	o.logins[id] = oidcLogin{user, time.Now()}
+
+	return id
+}
+
+func (o *OIDC) requestLogin(r *http.Request) (oidcLogin, bool) {
+	cookie, err := r.Cookie(OIDCCookie)
+	if err != nil {
+		return oidcLogin{}, false
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	login, ok := o.logins[cookie.Value]
+
+	return login, ok
+}
+
+func (o *OIDC) Logout(r *http.Request) {
+	cookie, err := r.Cookie(OIDCCookie)
+	if err != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.logins, cookie.Value)
+}
+
+func verifyChallenge(code authorizationCode, verifier string) bool {
+	if code.challenge == "" {
+		return true
+	}
+
+	expected := verifier
+	if code.method == "S256" {
+		digest := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(digest[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(code.challenge)) == 1
+}
+
+func InitOIDCHandlers(router *httprouter.Router) {
+	prefix := auth.config.Path
+
+	router.GET(prefix+"/.well-known/openid-configuration", allowCORS(handleDiscovery))
+	router.GET(prefix+"/jwks", allowCORS(handleJWKS))
+	router.GET(prefix+"/authorize", handleAuthorize)
+	router.POST(prefix+"/authorize", handleAuthorizeLogin)
+	router.POST(prefix+"/token", allowCORS(handleToken))
+	router.GET(prefix+"/userinfo", allowCORS(handleUserinfo))
+	router.POST(prefix+"/userinfo", allowCORS(handleUserinfo))
+	router.GET(prefix+"/end-session", handleEndSession)
+
+	for _, endpoint := range []string{"/.well-known/openid-configuration", "/jwks", "/token", "/userinfo"} {
+		router.OPTIONS(prefix+endpoint, allowCORS(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+	}
+}
+
+// allowCORS lets single-page apps served from another origin call the endpoint.
+func allowCORS(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+
+		handle(w, r, ps)
+	}
+}
+
+func handleDiscovery(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	claims := []string{"sub"}
+	for claim := range oidc.config.Claims {
+		claims = append(claims, claim)
+	}
+	slices.Sort(claims)
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                oidc.issuer,
+		"authorization_endpoint":                oidc.issuer + "/authorize",
+		"token_endpoint":                        oidc.issuer + "/token",
+		"userinfo_endpoint":                     oidc.issuer + "/userinfo",
+		"jwks_uri":                              oidc.issuer + "/jwks",
+		"end_session_endpoint":                  oidc.issuer + "/end-session",
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"none", "client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+		"claims_supported":                      claims,
+	})
+}
+
+func handleJWKS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := oidc.key.PublicKey
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": oidc.keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorizationRequest validates the client and the redirect URI of the request. Other errors are reported to the
+// client by redirecting back to it.
+func authorizationRequest(query url.Values) (OIDCClient, error) {
+	client, ok := oidc.client(query.Get("client_id"))
+	if !ok {
+		return client, errors.New("unknown client: " + query.Get("client_id"))
+	}
+
+	if !oidc.allowsRedirect(client.RedirectUris, query.Get("redirect_uri")) {
+		return client, errors.New("invalid redirect_uri: " + query.Get("redirect_uri"))
+	}
+
+	return client, nil
+}
+
+func redirectWithError(w http.ResponseWriter, r *http.Request, query url.Values, code string, description string) {
+	target, _ := url.Parse(query.Get("redirect_uri"))
+	params := target.Query()
+	params.Set("error", code)
+	params.Set("error_description", description)
+	if query.Get("state") != "" {
+		params.Set("state", query.Get("state"))
+	}
+	target.RawQuery = params.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+func redirectWithCode(w http.ResponseWriter, r *http.Request, query url.Values, login oidcLogin) {
+	code := oidc.IssueCode(authorizationCode{
+		clientId:      query.Get("client_id"),
+		redirectUri:   query.Get("redirect_uri"),
+		challenge:     query.Get("code_challenge"),
+		method:        query.Get("code_challenge_method"),
+		nonce:         query.Get("nonce"),
+		scope:         query.Get("scope"),
+		user:          login.user,
+		authenticated: login.authenticated,
+	})
+
+	target, _ := url.Parse(query.Get("redirect_uri"))
+	params := target.Query()
+	params.Set("code", code)
+	if query.Get("state") != "" {
+		params.Set("state", query.Get("state"))
+	}
+	target.RawQuery = params.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusSeeOther)
+}
+
+// validAuthorization checks the parameters of the authorization request, redirecting back with an error if they're
+// invalid.
+func validAuthorization(w http.ResponseWriter, r *http.Request, query url.Values) bool {
+	client, err := authorizationRequest(query)
+	if err != nil {
+		http.Error(w, "Invalid authorization request: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	switch {
+	case query.Get("response_type") != "code":
+		redirectWithError(w, r, query, "unsupported_response_type", "Only the code response type is supported")
+	case query.Get("code_challenge") == "" && client.Secret == "":
+		redirectWithError(w, r, query, "invalid_request", "Public clients must use PKCE")
+	case !slices.Contains([]string{"", "plain", "S256"}, query.Get("code_challenge_method")):
+		redirectWithError(w, r, query, "invalid_request", "Unsupported code_challenge_method")
+	default:
+		return true
+	}
+
+	return false
+}
+
+func handleAuthorize(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := r.URL.Query()
+	if !validAuthorization(w, r, query) {
+		return
+	}
+
+	prompt := strings.Fields(query.Get("prompt"))
+
+	if login, ok := oidc.requestLogin(r); ok && !slices.Contains(prompt, "login") {
+		redirectWithCode(w, r, query, login)
+		return
+	}
+
+	if slices.Contains(prompt, "none") {
+		redirectWithError(w, r, query, "login_required", "The user isn't logged in")
+		return
+	}
+
+	renderLoginPage(w, http.StatusOK, query, "", "")
+}
+
+func handleAuthorizeLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Invalid form: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, err := url.ParseQuery(r.PostForm.Get("request"))
+	if err != nil || !validAuthorization(w, r, query) {
+		if err != nil {
+			http.Error(w, "Invalid authorization request", http.StatusBadRequest)
+		}
+		return
+	}
+
+	table, ok := usersTable(w, r)
+	if !ok {
+		return
+	}
+
+	username := r.PostForm.Get("username")
+	user, err := auth.Login(table, username, r.PostForm.Get("password"))
+	if err != nil {
+		renderLoginPage(w, http.StatusUnauthorized, query, username, "Invalid credentials")
+		return
+	}
+
+	id := oidc.Login(user)
+	http.SetCookie(w, &http.Cookie{Name: OIDCCookie, Value: id, Path: auth.config.Path, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	redirectWithCode(w, r, query, oidcLogin{user, time.Now()})
+}
+
+func renderLoginPage(w http.ResponseWriter, status int, query url.Values, username string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	_ = loginPage.Execute(w, map[string]any{
+		"Action":        auth.config.Path + "/authorize",
+		"Request":       query.Encode(),
+		"Client":        query.Get("client_id"),
+		"Username":      username,
+		"UsernameField": auth.config.UsernameField,
+		"Error":         message,
+	})
+}
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Sign in - amock</title>
+  <style>
+    body { font-family: system-ui, sans-serif; background: #f4f4f5; display: flex; justify-content: center; padding-top: 10vh; }
+    form { background: #fff; padding: 2rem; border-radius: 8px; box-shadow: 0 1px 4px rgba(0, 0, 0, .1); width: 20rem; }
+    label, input, button { display: block; width: 100%; box-sizing: border-box; }
+    input { margin: .25rem 0 1rem; padding: .5rem; }
+    button { padding: .6rem; }
+    .error { color: #b91c1c; }
+  </style>
+</head>
+<body>
+  <form method="post" action="{{.Action}}">
+    <h1>Sign in</h1>
+    <p>to <strong>{{.Client}}</strong></p>
+    {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+    <input type="hidden" name="request" value="{{.Request}}">
+    <label for="username">{{.UsernameField}}</label>
+    <input id="username" name="username" value="{{.Username}}" autofocus required>
+    <label for="password">password</label>
+    <input id="password" name="password" type="password" required>
+    <button type="submit">Sign in</button>
+  </form>
+</body>
+</html>
+`))
+
+func writeTokenError(w http.ResponseWriter, code int, err string, description string) {
+	writeAdminJSON(w, code, map[string]string{"error": err, "error_description": description})
+}
+
+func handleToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := r.ParseForm()
+	if err != nil {
+		writeTokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	clientId, secret, basic := r.BasicAuth()
+	if !basic {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, ok := oidc.client(clientId)
+	if !ok || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		writeTokenError(w, http.StatusUnauthorized, "invalid_client", "Unknown client or wrong secret")
+		return
+	}
+
+	var user Entity
+	var nonce, scope string
+	authenticated := time.Now()
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code, ok := oidc.RedeemCode(r.PostForm.Get("code"))
+		if !ok || code.clientId != clientId || code.redirectUri != r.PostForm.Get("redirect_uri") {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired code")
+			return
+		}
+		if !verifyChallenge(code, r.PostForm.Get("code_verifier")) {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid code_verifier")
+			return
+		}
+		user, nonce, scope, authenticated = code.user, code.nonce, code.scope, code.authenticated
+	case "refresh_token":
+		principal, err := auth.Refresh(r.PostForm.Get("refresh_token"))
+		if err != nil {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "Invalid or expired refresh token")
+			return
+		}
+
+		table, ok := usersTable(w, r)
+		if !ok {
+			return
+		}
+
+		user, err = FindById(table, principal.Subject)
+		if err != nil {
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists")
+			return
+		}
+		scope = r.PostForm.Get("scope")
+	default:
+		writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type: "+r.PostForm.Get("grant_type"))
+		return
+	}
+
+	access, refresh, err := auth.Issue(auth.principal(user))
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	idToken, err := oidc.IdToken(user, clientId, nonce, authenticated)
+	if err != nil {
+		writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+
+	response := map[string]any{
+		"access_token":  access,
+		"token_type":    "Bearer",
+		"expires_in":    auth.config.Expiry,
+		"refresh_token": refresh,
+		"id_token":      idToken,
+	}
+	if scope != "" {
+		response["scope"] = scope
+	}
+
+	writeAdminJSON(w, http.StatusOK, response)
+}
+
+func handleUserinfo(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	principal, err := auth.Verify(bearerToken(r))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return
+	}
+
+	table, ok := usersTable(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := FindById(table, principal.Subject)
+	if err != nil {
+		handleFindError(w, err)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, oidc.Claims(user))
+}
+
+func handleEndSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	oidc.Logout(r)
+	http.SetCookie(w, &http.Cookie{Name: OIDCCookie, Path: auth.config.Path, MaxAge: -1})
+
+	query := r.URL.Query()
+	redirect := query.Get("post_logout_redirect_uri")
+
+	var allowed []string
+	for _, client := range oidc.config.Clients {
+		if query.Get("client_id") == "" || client.Id == query.Get("client_id") {
+			allowed = append(allowed, client.PostLogoutRedirectUris...)
+		}
+	}
+
+	if redirect == "" || !oidc.allowsRedirect(allowed, redirect) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("Signed out\n"))
+		return
+	}
+
+	target, _ := url.Parse(redirect)
+	params := target.Query()
+	if query.Get("state") != "" {
+		params.Set("state", query.Get("state"))
+	}
+	target.RawQuery = params.Encode()
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testIssuer      = "http://amock.test/auth"
+	testRedirectUri = "http://app.test/callback"
+	testVerifier    = "dBjftJeZ4CVP-mJ92K1qUc6xvhvdDb5mzzVnNSR2wFg"
+)
+
+var oidcTestEntities = map[string]string{
+	"user.json": `{"id": "id.sequence", "name": "string.firstname", "email": "string.email", "password": "string.password", "role": "string.word"}`,
+}
+
+// newOIDCTestServer starts a server with a public client and a user to sign in with. The returned client keeps the
+// cookies and doesn't follow redirects.
+func newOIDCTestServer(t *testing.T) (*httptest.Server, *http.Client) {
+	t.Helper()
+
+	server := httptest.NewServer(newTestServer(t, Config{
+		Auth: AuthConfig{
+			Table:         "user",
+			UsernameField: "email",
+			OIDC: OIDCConfig{
+				Enabled: true,
+				Issuer:  testIssuer,
+				Clients: []OIDCClient{{Id: "spa", RedirectUris: []string{testRedirectUri}}},
+			},
+		},
+	}, oidcTestEntities))
+	t.Cleanup(server.Close)
+
+	res, content := request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "Jane", "email": "jane@example.com", "password": "secret", "role": "admin"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating the user responded with %d: %s", res.StatusCode, content)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return server, client
+}
+
+func authorizationQuery(extra ...string) url.Values {
+	digest := sha256.Sum256([]byte(testVerifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"spa"},
+		"redirect_uri":          {testRedirectUri},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(digest[:])},
+		"code_challenge_method": {"S256"},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		query.Set(extra[i], extra[i+1])
+	}
+
+	return query
+}
+
+// redirectParams returns the query parameters of the redirect back to the client.
+func redirectParams(t *testing.T, res *http.Response) url.Values {
+	t.Helper()
+
+	location, err := res.Location()
+	if err != nil {
+		t.Fatalf("expected a redirect, got %d", res.StatusCode)
+	}
+	if !strings.HasPrefix(location.String(), testRedirectUri+"?") {
+		t.Fatalf("expected a redirect to the client, got %s", location)
+	}
+
+	return location.Query()
+}
+
+func signIn(t *testing.T, server *httptest.Server, client *http.Client, password string) *http.Response {
+	t.Helper()
+
+	res, err := client.PostForm(server.URL+"/auth/authorize", url.Values{
+		"request":  {authorizationQuery().Encode()},
+		"username": {"jane@example.com"},
+		"password": {password},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res
+}
+
+func exchangeToken(t *testing.T, server *httptest.Server, form url.Values) (int, map[string]any) {
+	t.Helper()
+
+	res, err := http.PostForm(server.URL+"/auth/token", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body map[string]any
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res.StatusCode, body
+}
+
+func codeForm(code string, verifier string) url.Values {
+	return url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {"spa"},
+		"redirect_uri":  {testRedirectUri},
+		"code":          {code},
+		"code_verifier": {verifier},
+	}
+}
+
+// verifyIdToken checks the signature of the ID token with the key published by the JWKS endpoint and returns its
+// claims.
+func verifyIdToken(t *testing.T, server *httptest.Server, token string) map[string]any {
+	t.Helper()
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	_, content := request(t, http.MethodGet, server.URL+"/auth/jwks", nil)
+	err := json.Unmarshal(content, &jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != "RS256" {
+		t.Fatalf("expected one RS256 key, got %s", content)
+	}
+
+	n, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed ID token %s", token)
+	}
+
+	var header map[string]string
+	decodeSegment(t, parts[0], &header)
+	if header["kid"] != jwks.Keys[0].Kid {
+		t.Errorf("expected the key ID %s, got %s", jwks.Keys[0].Kid, header["kid"])
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		t.Fatalf("invalid ID token signature: %v", err)
+	}
+
+	var claims map[string]any
+	decodeSegment(t, parts[1], &claims)
+
+	return claims
+}
+
+func decodeSegment(t *testing.T, segment string, v any) {
+	t.Helper()
+
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(content, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	server, _ := newOIDCTestServer(t)
+
+	res, content := request(t, http.MethodGet, server.URL+"/auth/.well-known/openid-configuration", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("discovery responded with %d", res.StatusCode)
+	}
+	if res.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("expected the discovery document to allow cross-origin requests")
+	}
+
+	var discovery map[string]any
+	err := json.Unmarshal(content, &discovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"issuer":                 testIssuer,
+		"authorization_endpoint": testIssuer + "/authorize",
+		"token_endpoint":         testIssuer + "/token",
+		"jwks_uri":               testIssuer + "/jwks",
+	}
+	for key, value := range expected {
+		if discovery[key] != value {
+			t.Errorf("expected %s to be %s, got %v", key, value, discovery[key])
+		}
+	}
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	server, client := newOIDCTestServer(t)
+
+	res, err := client.Get(server.URL + "/auth/authorize?" + authorizationQuery().Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("expected the login page, got %d", res.StatusCode)
+	}
+
+	res = signIn(t, server, client, "wrong")
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for wrong credentials, got %d", res.StatusCode)
+	}
+
+	params := redirectParams(t, signIn(t, server, client, "secret"))
+	if params.Get("state") != "xyz" || params.Get("code") == "" {
+		t.Fatalf("expected a code and the state, got %v", params)
+	}
+
+	status, body := exchangeToken(t, server, codeForm(params.Get("code"), "wrong-verifier"))
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a wrong code_verifier, got %d %v", status, body)
+	}
+
+	// The login cookie signs the user in again without the login page, and every code can be used only once.
+	res, err = client.Get(server.URL + "/auth/authorize?" + authorizationQuery("prompt", "none").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	code := redirectParams(t, res).Get("code")
+
+	status, tokens := exchangeToken(t, server, codeForm(code, testVerifier))
+	if status != http.StatusOK {
+		t.Fatalf("exchanging the code responded with %d: %v", status, tokens)
+	}
+
+	status, body = exchangeToken(t, server, codeForm(code, testVerifier))
+	if status != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("expected invalid_grant for a used code, got %d %v", status, body)
+	}
+
+	claims := verifyIdToken(t, server, tokens["id_token"].(string))
+	expected := map[string]any{"iss": testIssuer, "aud": "spa", "nonce": "n-0S6_WzA2Mj", "email": "jane@example.com", "role": "admin"}
+	for key, value := range expected {
+		if claims[key] != value {
+			t.Errorf("expected the claim %s to be %v, got %v", key, value, claims[key])
+		}
+	}
+
+	res, content := request(t, http.MethodGet, server.URL+"/auth/userinfo", nil, "Authorization", "Bearer "+tokens["access_token"].(string))
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(content), `"email":"jane@example.com"`) {
+		t.Errorf("expected the claims of the user, got %d: %s", res.StatusCode, content)
+	}
+
+	status, refreshed := exchangeToken(t, server, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"spa"},
+		"refresh_token": {tokens["refresh_token"].(string)},
+	})
+	if status != http.StatusOK || refreshed["id_token"] == nil {
+		t.Errorf("expected new tokens for the refresh token, got %d %v", status, refreshed)
+	}
+}
+
+func TestOIDCAuthorizationErrors(t *testing.T) {
+	server, client := newOIDCTestServer(t)
+
+	res, err := client.Get(server.URL + "/auth/authorize?" + authorizationQuery("redirect_uri", "http://evil.test/").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unregistered redirect_uri, got %d", res.StatusCode)
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+		error string
+	}{
+		{"without PKCE", authorizationQuery("code_challenge", ""), "invalid_request"},
+		{"unknown challenge method", authorizationQuery("code_challenge_method", "S512"), "invalid_request"},
+		{"implicit flow", authorizationQuery("response_type", "token"), "unsupported_response_type"},
+		{"silent without login", authorizationQuery("prompt", "none"), "login_required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res, err := client.Get(server.URL + "/auth/authorize?" + test.query.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			params := redirectParams(t, res)
+			if params.Get("error") != test.error || params.Get("state") != "xyz" {
+				t.Errorf("expected the error %s with the state, got %v", test.error, params)
+			}
+		})
+	}
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v3"
+)
+
+const OpenAPIPath = "/__amock/openapi.json"
+const DocsPath = "/__amock/docs"
+
+type OpenAPIObject map[string]any
+
+// OpenAPIDocument describes the API served by the mock as an OpenAPI 3.1 document, built from the registered routes
+// and the definitions of the tables.
+func OpenAPIDocument(serverUrl string) OpenAPIObject {
+	if version == "" {
+		version = "development"
+	}
+
+	schemas := OpenAPIObject{}
+	for _, table := range db.Tables {
+		schemas[schemaName(table)] = tableSchema(table)
+	}
+
+	paths := OpenAPIObject{}
+	for _, route := range Routes {
+		operation := routeOperation(route)
+		if operation == nil {
+			continue
+		}
+
+		routePath := openAPIPath(route.Path)
+		item, ok := paths[routePath].(OpenAPIObject)
+		if !ok {
+			item = OpenAPIObject{}
+			paths[routePath] = item
+		}
+
+		item[strings.ToLower(route.Method)] = operation
+	}
+
+	return OpenAPIObject{
+		"openapi": "3.1.0",
+		"info": OpenAPIObject{
+			"title":   "amock",
+			"version": version,
+		},
+		"servers": []OpenAPIObject{{"url": serverUrl}},
+		"paths":   paths,
+		"components": OpenAPIObject{
+			"schemas": schemas,
+		},
+	}
+}
+
+// WriteOpenAPI writes the document to the file, as YAML if the file has a .yaml or .yml extension and as JSON
+// otherwise.
+func WriteOpenAPI(file string, document OpenAPIObject) error {
+	var b []byte
+	var err error
+
+	switch strings.ToLower(path.Ext(file)) {
+	case ".yaml", ".yml":
+		b, err = yaml.Marshal(document)
+	default:
+		b, err = json.MarshalIndent(document, "", "  ")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, b, 0644)
+}
+
+func openAPICommand(args []string) error {
+	file := "openapi.json"
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	initDatabase()
+	InitHandlers(config, &db)
+
+	err := WriteOpenAPI(file, OpenAPIDocument(constructUrl()))
+	if err != nil {
+		return err
+	}
+
+	println("OpenAPI document written to " + file)
+
+	return nil
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	base := requestUrl(r)
+	base.Path = ""
+	base.RawQuery = ""
+
+	content, err := json.Marshal(OpenAPIDocument(base.String()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _ = w.Write(content)
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	_, _ = w.Write([]byte(strings.ReplaceAll(docsPage, "{{spec}}", OpenAPIPath)))
+}
+
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>amock API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "{{spec}}", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+func schemaName(table *Table) string {
+	if table.Name == "" {
+		return table.Name
+	}
+
+	return strings.ToUpper(table.Name[:1]) + table.Name[1:]
+}
+
+func schemaRef(table *Table) OpenAPIObject {
+	return OpenAPIObject{"$ref": "#/components/schemas/" + schemaName(table)}
+}
+
+func tableSchema(table *Table) OpenAPIObject {
+	properties := OpenAPIObject{}
+	var required []string
+
+	for key, field := range table.Definition {
+		if field.Children {
+			continue
+		}
+
+		properties[key] = FieldSchema(field)
+
+		if field.Required {
+			required = append(required, key)
+		}
+	}
+
+	schema := OpenAPIObject{
+		"type":       "object",
+		"properties": properties,
+	}
+
+	if len(required) > 0 {
+		slices.Sort(required)
+		schema["required"] = required
+	}
+
+	return schema
+}
+
+// FieldSchema maps the type of the field to a JSON schema matching the values generated for it.
+func FieldSchema(field *Field) OpenAPIObject {
+	schema := OpenAPIObject{}
+	params := strings.TrimPrefix(field.Params, ":")
+
+	switch field.Type {
+	case "string":
+		schema["type"] = "string"
+		switch field.Subtype {
+		case "email":
+			schema["format"] = "email"
+		case "url":
+			schema["format"] = "uri"
+		case "ip":
+			schema["format"] = "ipv4"
+		case "ipv6":
+			schema["format"] = "ipv6"
+		case "password":
+			schema["format"] = "password"
+		}
+	case "number":
+		switch field.Subtype {
+		case "", "int":
+			schema["type"] = "integer"
+		case "decimal":
+			schema["type"] = "string"
+			schema["format"] = "decimal"
+		default:
+			schema["type"] = "number"
+		}
+		if field.Subtype != "decimal" {
+			numberRange(schema, params)
+		}
+	case "date":
+		switch field.Subtype {
+		case "timestamp":
+			schema["type"] = "integer"
+			schema["format"] = "unix-time"
+		case "day", "year":
+			schema["type"] = "integer"
+		case "month":
+			if params == "string" {
+				schema["type"] = "string"
+			} else {
+				schema["type"] = "integer"
+			}
+		case "weekday":
+			schema["type"] = "string"
+		case "":
+			schema["type"] = "string"
+			if params == "" || params == "RFC3339" || params == "RFC3339Nano" {
+				schema["format"] = "date-time"
+			}
+		default:
+			schema["type"] = "string"
+			schema["format"] = "date-time"
+		}
+	case "bool":
+		schema["type"] = "boolean"
+	case "enum":
+		schema["type"] = "string"
+		schema["enum"] = strings.Split(params, ",")
+	case "id":
+		if field.Subtype == "uuid" {
+			schema["type"] = "string"
+			schema["format"] = "uuid"
+		} else {
+			schema["type"] = "integer"
+		}
+	case "ref":
+		ref := field.Reference()
+		schema = referenceSchema(ref)
+		if ref.Many {
+			schema = OpenAPIObject{"type": "array", "items": schema}
+		}
+		schema["description"] = "References " + ref.Table
+	}
+
+	if field.Nullable {
+		if t, ok := schema["type"].(string); ok {
+			schema["type"] = []string{t, "null"}
+		}
+	}
+
+	return schema
+}
+
+func referenceSchema(ref *Reference) OpenAPIObject {
+	if table, ok := db.Tables[ref.Table]; ok {
+		if id, ok := table.Definition["id"]; ok && id.Type != "ref" {
+			return FieldSchema(&Field{Type: id.Type, Subtype: id.Subtype, Params: id.Params})
+		}
+	}
+
+	return OpenAPIObject{"type": []string{"integer", "string"}}
+}
+
+func numberRange(schema OpenAPIObject, params string) {
+	if !strings.Contains(params, "-") {
+		return
+	}
+
+	groups, err := NumberRangePattern.Groups(params)
+	if err != nil {
+		return
+	}
+
+	if n, err := strconv.ParseFloat(groups["min"], 64); err == nil {
+		schema["minimum"] = n
+	}
+	if n, err := strconv.ParseFloat(groups["max"], 64); err == nil {
+		schema["maximum"] = n
+	}
+}
+
+// openAPIPath converts the httprouter parameters of a path to OpenAPI templates, e.g. /user/:id to /user/{id}.
+func openAPIPath(routePath string) string {
+	parts := strings.Split(routePath, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ":") {
+			parts[i] = "{" + part[1:] + "}"
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func routeOperation(route Route) OpenAPIObject {
+	parts := strings.Split(strings.Trim(route.Path, "/"), "/")
+
+	table, ok := db.Tables[parts[0]]
+	if !ok {
+		return nil
+	}
+
+	switch len(parts) {
+	case 1:
+		return collectionOperation(route.Method, table, nil)
+	case 2:
+		if parts[1] == "_events" {
+			return eventsOperation(table)
+		}
+		return entityOperation(route.Method, table)
+	case 3:
+		field, ok := table.Definition[parts[2]]
+		if !ok || !field.Children {
+			return nil
+		}
+		child, ok := db.Tables[field.ChildTable()]
+		if !ok {
+			return nil
+		}
+		return collectionOperation(route.Method, child, table)
+	}
+
+	return nil
+}
+
+func collectionOperation(method string, table *Table, parent *Table) OpenAPIObject {
+	name := schemaName(table)
+	operation := OpenAPIObject{"tags": []string{table.Name}}
+	var parameters []OpenAPIObject
+
+	if parent != nil {
+		operation["tags"] = []string{parent.Name}
+		parameters = append(parameters, idParameter(parent))
+	}
+
+	switch method {
+	case http.MethodGet:
+		operation["summary"] = "List " + table.Name
+		operation["operationId"] = "list" + name
+		if parent != nil {
+			operation["summary"] = "List " + table.Name + " of a " + parent.Name
+			operation["operationId"] = "list" + schemaName(parent) + name
+		}
+
+		parameters = append(parameters, collectionParameters(table)...)
+
+		list := OpenAPIObject{"type": "array", "items": schemaRef(table)}
+		response := OpenAPIObject{
+			"description": "The " + table.Name,
+			"content":     jsonContent(list),
+		}
+
+		if config.Pagination == "envelope" {
+			response["content"] = jsonContent(OpenAPIObject{
+				"type": "object",
+				"properties": OpenAPIObject{
+					"first": OpenAPIObject{"type": "integer"},
+					"last":  OpenAPIObject{"type": "integer"},
+					"prev":  OpenAPIObject{"type": "integer"},
+					"next":  OpenAPIObject{"type": "integer"},
+					"pages": OpenAPIObject{"type": "integer"},
+					"count": OpenAPIObject{"type": "integer"},
+					"items": list,
+				},
+			})
+		} else {
+			response["headers"] = OpenAPIObject{
+				"X-Total-Count": OpenAPIObject{"description": "Number of matching entities", "schema": OpenAPIObject{"type": "integer"}},
+				"Link":          OpenAPIObject{"description": "Links to the first, previous, next and last page", "schema": OpenAPIObject{"type": "string"}},
+			}
+		}
+
+		operation["responses"] = OpenAPIObject{
+			"200": response,
+			"400": errorResponse("Invalid filter, sort or pagination parameter"),
+		}
+	case http.MethodPost:
+		operation["summary"] = "Create " + table.Name
+		operation["operationId"] = "create" + name
+		if parent != nil {
+			operation["summary"] = "Create " + table.Name + " of a " + parent.Name
+			operation["operationId"] = "create" + schemaName(parent) + name
+		}
+
+		body := OpenAPIObject{"oneOf": []OpenAPIObject{
+			schemaRef(table),
+			{"type": "array", "items": schemaRef(table)},
+		}}
+
+		operation["requestBody"] = OpenAPIObject{"required": true, "content": jsonContent(body)}
+		operation["responses"] = OpenAPIObject{
+			"200": OpenAPIObject{"description": "The created " + table.Name, "content": jsonContent(body)},
+			"400": errorResponse("Invalid entity"),
+			"422": errorResponse("Relation fields can't be set"),
+		}
+	default:
+		return nil
+	}
+
+	if parent != nil {
+		operation["responses"].(OpenAPIObject)["404"] = errorResponse(schemaName(parent) + " not found")
+	}
+
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	return operation
+}
+
+func entityOperation(method string, table *Table) OpenAPIObject {
+	name := schemaName(table)
+	operation := OpenAPIObject{
+		"tags":       []string{table.Name},
+		"parameters": []OpenAPIObject{idParameter(table)},
+	}
+
+	responses := OpenAPIObject{
+		"200": OpenAPIObject{"description": "The " + table.Name, "content": jsonContent(schemaRef(table))},
+		"404": errorResponse(name + " not found"),
+	}
+
+	switch method {
+	case http.MethodGet:
+		operation["summary"] = "Get " + table.Name
+		operation["operationId"] = "get" + name
+		operation["parameters"] = append(operation["parameters"].([]OpenAPIObject), relationParameters()...)
+		responses["400"] = errorResponse("Invalid relation")
+	case http.MethodPut:
+		operation["summary"] = "Replace " + table.Name
+		operation["operationId"] = "replace" + name
+		operation["requestBody"] = OpenAPIObject{"required": true, "content": jsonContent(schemaRef(table))}
+		responses["400"] = errorResponse("Invalid entity")
+	case http.MethodPatch:
+		operation["summary"] = "Update " + table.Name
+		operation["operationId"] = "update" + name
+		operation["requestBody"] = OpenAPIObject{
+			"required": true,
+			"content": OpenAPIObject{
+				"application/merge-patch+json": OpenAPIObject{"schema": OpenAPIObject{"type": "object"}},
+				"application/json-patch+json": OpenAPIObject{"schema": OpenAPIObject{
+					"type": "array",
+					"items": OpenAPIObject{
+						"type":     "object",
+						"required": []string{"op", "path"},
+						"properties": OpenAPIObject{
+							"op":    OpenAPIObject{"type": "string", "enum": []string{"add", "remove", "replace", "move", "copy", "test"}},
+							"path":  OpenAPIObject{"type": "string"},
+							"from":  OpenAPIObject{"type": "string"},
+							"value": OpenAPIObject{},
+						},
+					},
+				}},
+			},
+		}
+		responses["400"] = errorResponse("Invalid entity")
+		responses["415"] = errorResponse("Unsupported patch format")
+		responses["422"] = errorResponse("The patch can't be applied")
+	case http.MethodDelete:
+		operation["summary"] = "Delete " + table.Name
+		operation["operationId"] = "delete" + name
+		responses["200"] = OpenAPIObject{"description": "The " + table.Name + " was removed"}
+		responses["409"] = errorResponse(name + " is still referenced")
+	default:
+		return nil
+	}
+
+	operation["responses"] = responses
+
+	return operation
+}
+
+func eventsOperation(table *Table) OpenAPIObject {
+	return OpenAPIObject{
+		"tags":        []string{table.Name},
+		"summary":     "Stream changes of " + table.Name,
+		"description": "Server-Sent Events for every created, updated and deleted " + table.Name,
+		"operationId": "stream" + schemaName(table) + "Events",
+		"responses": OpenAPIObject{
+			"200": OpenAPIObject{
+				"description": "Event stream",
+				"content": OpenAPIObject{"text/event-stream": OpenAPIObject{"schema": OpenAPIObject{
+					"type": "object",
+					"properties": OpenAPIObject{
+						"id":        OpenAPIObject{"type": "integer"},
+						"type":      OpenAPIObject{"type": "string", "enum": []string{EventCreated, EventUpdated, EventDeleted}},
+						"table":     OpenAPIObject{"type": "string"},
+						"entityId":  OpenAPIObject{},
+						"entity":    schemaRef(table),
+						"time":      OpenAPIObject{"type": "string", "format": "date-time"},
+						"synthetic": OpenAPIObject{"type": "boolean"},
+					},
+				}}},
+			},
+		},
+	}
+}
+
+func idParameter(table *Table) OpenAPIObject {
+	schema := OpenAPIObject{"type": "string"}
+	if id, ok := table.Definition["id"]; ok {
+		schema = FieldSchema(&Field{Type: id.Type, Subtype: id.Subtype, Params: id.Params})
+	}
+
+	return OpenAPIObject{"name": "id", "in": "path", "required": true, "schema": schema}
+}
+
+func collectionParameters(table *Table) []OpenAPIObject {
+	parameters := []OpenAPIObject{
+		queryParameter("_page", "Page number, starting at 1", OpenAPIObject{"type": "integer", "minimum": 1}),
+		queryParameter("_limit", "Number of entities per page", OpenAPIObject{"type": "integer", "minimum": 1}),
+		queryParameter("_start", "Index of the first entity to return", OpenAPIObject{"type": "integer", "minimum": 0}),
+		queryParameter("_end", "Index after the last entity to return", OpenAPIObject{"type": "integer", "minimum": 0}),
+		queryParameter("_sort", "Comma separated fields to sort by, prefixed with - for descending order", OpenAPIObject{"type": "string"}),
+		queryParameter("_order", "Sort order of the fields in _sort (asc or desc)", OpenAPIObject{"type": "string"}),
+	}
+
+	parameters = append(parameters, relationParameters()...)
+
+	for _, key := range sortedKeys(table.Definition) {
+		field := table.Definition[key]
+		if field.Children {
+			continue
+		}
+
+		parameters = append(parameters, queryParameter(key, "Filter by "+key+", see the filter operators like "+key+"_ne or "+key+"_gte", OpenAPIObject{"type": "string"}))
+	}
+
+	return parameters
+}
+
+func relationParameters() []OpenAPIObject {
+	return []OpenAPIObject{
+		queryParameter("_embed", "Comma separated child relations to embed", OpenAPIObject{"type": "string"}),
+		queryParameter("_expand", "Comma separated references to expand", OpenAPIObject{"type": "string"}),
+	}
+}
+
+func queryParameter(name string, description string, schema OpenAPIObject) OpenAPIObject {
+	return OpenAPIObject{"name": name, "in": "query", "description": description, "schema": schema}
+}
+
+func jsonContent(schema OpenAPIObject) OpenAPIObject {
+	return OpenAPIObject{"application/json": OpenAPIObject{"schema": schema}}
+}
+
+func errorResponse(description string) OpenAPIObject {
+	return OpenAPIObject{
+		"description": description,
+		"content":     OpenAPIObject{"text/plain": OpenAPIObject{"schema": OpenAPIObject{"type": "string"}}},
+	}
+}
+
+func sortedKeys(definition map[string]*Field) []string {
+	keys := make([]string, 0, len(definition))
+	for key := range definition {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+// OwnershipConfig limits the entities of the owned tables to the callers who created them.
+type OwnershipConfig struct {
+	// Tables maps the owned tables to their owner fields.
+	Tables map[string]string `yaml:"tables" json:"tables"`
+	// Header identifies the caller of requests without a bearer token.
+	Header     string   `yaml:"header" json:"header"`
+	RoleHeader string   `yaml:"roleHeader" json:"roleHeader"`
+	AdminRoles []string `yaml:"adminRoles" json:"adminRoles"`
+}
+
+// Owner is the caller of a request to an owned table.
+type Owner struct {
+	Field string
+	Id    any
+	Admin bool
+}
+
+// Caller is the client of a request, identified by the bearer token or the owner header.
+type Caller struct {
+	Subject string
+	Role    string
+}
+
+type callerContextKey struct{}
+
+// RequestCaller returns the caller of the request, or nil if it's anonymous.
+func RequestCaller(r *http.Request) *Caller {
+	if principal, ok := RequestPrincipal(r); ok {
+		return &Caller{Subject: principal.Subject, Role: principal.Role}
+	}
+
+	if config.Ownership.Header != "" && r.Header.Get(config.Ownership.Header) != "" {
+		caller := &Caller{Subject: r.Header.Get(config.Ownership.Header)}
+		if config.Ownership.RoleHeader != "" {
+			caller.Role = r.Header.Get(config.Ownership.RoleHeader)
+		}
+		return caller
+	}
+
+	return nil
+}
+
+// WithCaller stores the caller in the context, for the GraphQL resolvers.
+func WithCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+func ContextCaller(ctx context.Context) *Caller {
+	caller, _ := ctx.Value(callerContextKey{}).(*Caller)
+	return caller
+}
+
+// Owner returns the caller as the owner of the entities of the table. It returns nil if the table isn't owned or the
+// caller is anonymous, in which case the access isn't limited.
+func (c *Caller) Owner(table *Table) *Owner {
+	if c == nil {
+		return nil
+	}
+
+	field, ok := config.Ownership.Tables[table.Name]
+	if !ok {
+		return nil
+	}
+
+	adminRoles := config.Ownership.AdminRoles
+	if len(adminRoles) == 0 {
+		adminRoles = []string{"admin"}
+	}
+
+	return &Owner{Field: field, Id: ownerValue(table, field, c.Subject), Admin: c.Role != "" && slices.Contains(adminRoles, c.Role)}
+}
+
+// RequestOwner returns the caller of the request as the owner of the entities of the table, see Caller.Owner.
+func RequestOwner(r *http.Request, table *Table) *Owner {
+	return RequestCaller(r).Owner(table)
+}
+
+// ownerValue converts the subject to the type of the owner field, or of the IDs it references.
+func ownerValue(table *Table, field string, subject string) any {
+	definition, ok := table.Definition[field]
+	if !ok {
+		return subject
+	}
+
+	if ref := definition.Reference(); ref != nil {
+		target, ok := table.Database().Tables[ref.Table]
+		if !ok || target.Definition["id"] == nil {
+			return subject
+		}
+		definition = target.Definition["id"]
+	}
+
+	value, err := ParseFieldValue(definition, subject)
+	if err != nil {
+		return subject
+	}
+
+	return value
+}
+
+// Scope returns the filter limiting a collection to the entities of the owner. Admins aren't limited.
+func (o *Owner) Scope() []Filter {
+	if o == nil || o.Admin {
+		return nil
+	}
+
+	return []Filter{{
+		Field:    o.Field,
+		Operator: "eq",
+		Value:    o.Id,
+		Apply: func(collection EntityCollection) EntityCollection {
+			var owned EntityCollection
+			for _, entity := range collection {
+				if o.Owns(entity) {
+					owned = append(owned, entity)
+				}
+			}
+			return owned
+		},
+	}}
+}
+
+// Owns reports whether the owner can access the entity.
+func (o *Owner) Owns(entity Entity) bool {
+	if o == nil || o.Admin {
+		return true
+	}
+
+	cmp, ok := CompareValues(entity[o.Field], o.Id)
+
+	return ok && cmp == 0
+}
+
+// Apply sets the owner field of created or updated data to the owner. Admins can set it to anyone, so it's only
+// filled in when missing from the data they create.
+func (o *Owner) Apply(data map[string]any, create bool) {
+	if o == nil {
+		return
+	}
+
+	if !o.Admin || (create && data[o.Field] == nil) {
+		data[o.Field] = o.Id
+	}
+}
+
+// findOwned returns the entity with the ID, responding with 404 if it doesn't exist or belongs to someone else.
+func findOwned(w http.ResponseWriter, r *http.Request, table *Table, id string) (Entity, bool) {
+	entity, err := FindById(table, id)
+	if err != nil {
+		handleFindError(w, err)
+		return nil, false
+	}
+
+	if !RequestOwner(r, table).Owns(entity) {
+		http.Error(w, "Entity not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return entity, true
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var ownershipTestEntities = map[string]string{
+	"user.json":    testEntities["user.json"],
+	"post.json":    testEntities["post.json"],
+	"comment.json": `{"id": "id.sequence", "post_id": "ref:post,cascade", "text": "string.sentence"}`,
+}
+
+// newOwnershipTestServer starts a server whose posts belong to their users, with a post of user 1 and one of user 2.
+func newOwnershipTestServer(t *testing.T) (*httptest.Server, float64, float64) {
+	t.Helper()
+
+	server := httptest.NewServer(newTestServer(t, Config{
+		GraphQL:   true,
+		Ownership: OwnershipConfig{Tables: map[string]string{"post": "user_id"}, Header: "X-User-Id"},
+	}, ownershipTestEntities))
+	t.Cleanup(server.Close)
+
+	var ids []float64
+	for _, user := range []string{"1", "2"} {
+		res, content := request(t, http.MethodPost, server.URL+"/post", map[string]any{"title": "Post of " + user}, "X-User-Id", user)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("creating a post responded with %d: %s", res.StatusCode, content)
+		}
+
+		var post Entity
+		err := json.Unmarshal(content, &post)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, post["id"].(float64))
+	}
+
+	return server, ids[0], ids[1]
+}
+
+func TestOwnershipOfRelations(t *testing.T) {
+	server, other, own := newOwnershipTestServer(t)
+
+	for _, id := range []float64{other, own} {
+		res, content := request(t, http.MethodPost, server.URL+"/comment", map[string]any{"post_id": id, "text": "Nice"})
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("creating a comment responded with %d: %s", res.StatusCode, content)
+		}
+	}
+
+	_, content := request(t, http.MethodGet, server.URL+"/user/1?_embed=post", nil, "X-User-Id", "2")
+
+	var user struct {
+		Posts []Entity `json:"post"`
+	}
+	err := json.Unmarshal(content, &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(user.Posts) != 0 {
+		t.Errorf("expected no embedded posts of another user, got %v", user.Posts)
+	}
+
+	_, content = request(t, http.MethodGet, server.URL+"/comment?_expand=post", nil, "X-User-Id", "2")
+
+	var comments []struct {
+		PostId float64 `json:"post_id"`
+		Post   Entity  `json:"post"`
+	}
+	err = json.Unmarshal(content, &comments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range comments {
+		if comment.PostId == other && comment.Post != nil {
+			t.Errorf("expected the post of another user not to be expanded, got %v", comment.Post)
+		}
+		if comment.PostId == own && comment.Post == nil {
+			t.Error("expected the own post to be expanded")
+		}
+	}
+}
+
+func TestOwnershipInGraphQL(t *testing.T) {
+	server, other, own := newOwnershipTestServer(t)
+
+	query := func(query string) map[string]any {
+		t.Helper()
+
+		res, content := request(t, http.MethodPost, server.URL+GraphQLPath, map[string]any{"query": query}, "X-User-Id", "2")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GraphQL responded with %d: %s", res.StatusCode, content)
+		}
+
+		var result map[string]any
+		err := json.Unmarshal(content, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return result
+	}
+
+	result := query(`{ allPost { id user_id } user(id: 1) { posts { id } } }`)
+	data := result["data"].(map[string]any)
+	for _, post := range data["allPost"].([]any) {
+		if post.(map[string]any)["user_id"] != float64(2) {
+			t.Errorf("expected only the own posts, got %v", post)
+		}
+	}
+	if posts := data["user"].(map[string]any)["posts"].([]any); len(posts) != 0 {
+		t.Errorf("expected no children of another user, got %v", posts)
+	}
+
+	result = query(`{ post(id: ` + IdKey(other) + `) { id } }`)
+	if post := result["data"].(map[string]any)["post"]; post != nil {
+		t.Errorf("expected no post of another user, got %v", post)
+	}
+
+	result = query(`{ post(id: ` + IdKey(own) + `) { id } }`)
+	if post := result["data"].(map[string]any)["post"]; post == nil {
+		t.Error("expected the own post")
+	}
+
+	for _, mutation := range []string{
+		`mutation { updatePost(id: ` + IdKey(other) + `, input: {title: "Mine"}) { id } }`,
+		`mutation { deletePost(id: ` + IdKey(other) + `) { id } }`,
+	} {
+		if result = query(mutation); result["errors"] == nil {
+			t.Errorf("expected an error changing the post of another user with %s", mutation)
+		}
+	}
+
+	result = query(`mutation { createPost(input: {user_id: 1, title: "Hello"}) { user_id } }`)
+	if post := result["data"].(map[string]any)["createPost"].(map[string]any); post["user_id"] != float64(2) {
+		t.Errorf("expected the created post to belong to the caller, got %v", post)
+	}
+}
+
+func TestOwnershipOfEvents(t *testing.T) {
+	server, _, _ := newOwnershipTestServer(t)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/post/_events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-User-Id", "2")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Wait for the subscription before changing the table.
+	<-lines
+
+	request(t, http.MethodPost, server.URL+"/post", map[string]any{"title": "Hidden"}, "X-User-Id", "1")
+	request(t, http.MethodPost, server.URL+"/post", map[string]any{"title": "Visible"}, "X-User-Id", "2")
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+
+			var event Event
+			err = json.Unmarshal([]byte(data), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.Entity["title"] != "Visible" {
+				t.Fatalf("expected only the events of the own posts, got %v", event.Entity)
+			}
+			return
+		case <-timeout:
+			t.Fatal("timed out waiting for the event")
+		}
+	}
+}
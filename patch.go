@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from"`
+	Value any    `json:"value"`
+}
+
+// ApplyMergePatch applies a JSON Merge Patch (RFC 7396) to the target document.
+func ApplyMergePatch(target any, patch any) any {
+	patchObject, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]any)
+	if !ok {
+		targetObject = map[string]any{}
+	} else {
+		targetObject = cloneObject(targetObject)
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = ApplyMergePatch(targetObject[key], value)
+	}
+
+	return targetObject
+}
+
+// ApplyJSONPatch applies a JSON Patch (RFC 6902) to the target document. The operations are applied to a copy, so
+// the target is left untouched if any of them fails.
+func ApplyJSONPatch(target any, operations []PatchOperation) (any, error) {
+	doc := deepCopy(target)
+
+	for i, op := range operations {
+		var err error
+
+		switch op.Op {
+		case "add":
+			doc, err = patchAdd(doc, op.Path, op.Value)
+		case "remove":
+			doc, _, err = patchRemove(doc, op.Path)
+		case "replace":
+			if _, err = patchGet(doc, op.Path); err == nil {
+				doc, _, err = patchRemove(doc, op.Path)
+				if err == nil {
+					doc, err = patchAdd(doc, op.Path, op.Value)
+				}
+			}
+		case "move":
+			if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+				err = errors.New("cannot move a value into one of its children")
+				break
+			}
+			var value any
+			doc, value, err = patchRemove(doc, op.From)
+			if err == nil {
+				doc, err = patchAdd(doc, op.Path, value)
+			}
+		case "copy":
+			var value any
+			value, err = patchGet(doc, op.From)
+			if err == nil {
+				doc, err = patchAdd(doc, op.Path, deepCopy(value))
+			}
+		case "test":
+			var value any
+			value, err = patchGet(doc, op.Path)
+			if err == nil && !reflect.DeepEqual(value, op.Value) {
+				err = errors.New("test failed for path " + op.Path)
+			}
+		default:
+			err = errors.New("unknown operation " + strconv.Quote(op.Op))
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("patch operation %d: %w", i, err)
+		}
+	}
+
+	return doc, nil
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.New("invalid JSON pointer " + strconv.Quote(pointer))
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+func patchGet(doc any, pointer string) (any, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, token := range tokens {
+		switch node := current.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.New("path not found " + pointer)
+			}
+			current = value
+		case []any:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, errors.New("path not found " + pointer)
+			}
+			current = node[index]
+		default:
+			return nil, errors.New("path not found " + pointer)
+		}
+	}
+
+	return current, nil
+}
+
+func patchAdd(doc any, pointer string, value any) (any, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := patchGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+		return doc, nil
+	case []any:
+		index := len(node)
+		if last != "-" {
+			index, err = strconv.Atoi(last)
+			if err != nil || index < 0 || index > len(node) {
+				return nil, errors.New("invalid array index in path " + pointer)
+			}
+		}
+		node = append(node[:index], append([]any{value}, node[index:]...)...)
+		return patchSet(doc, parentPointer, node)
+	}
+
+	return nil, errors.New("path not found " + pointer)
+}
+
+// patchSet overwrites the value at an existing location, which is needed to store arrays after they've been resized.
+func patchSet(doc any, pointer string, value any) (any, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := patchGet(doc, pointer[:strings.LastIndex(pointer, "/")])
+	if err != nil {
+		return nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+		return doc, nil
+	case []any:
+		index, err := strconv.Atoi(last)
+		if err != nil || index < 0 || index >= len(node) {
+			return nil, errors.New("path not found " + pointer)
+		}
+		node[index] = value
+		return doc, nil
+	}
+
+	return nil, errors.New("path not found " + pointer)
+}
+
+func patchRemove(doc any, pointer string) (any, any, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("cannot remove the whole document")
+	}
+
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := patchGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := tokens[len(tokens)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, errors.New("path not found " + pointer)
+		}
+		delete(node, last)
+		return doc, value, nil
+	case []any:
+		index, err := strconv.Atoi(last)
+		if err != nil || index < 0 || index >= len(node) {
+			return nil, nil, errors.New("path not found " + pointer)
+		}
+		value := node[index]
+		node = append(node[:index:index], node[index+1:]...)
+		doc, err = patchSet(doc, parentPointer, node)
+		if err != nil {
+			return nil, nil, err
+		}
+		return doc, value, nil
+	}
+
+	return nil, nil, errors.New("path not found " + pointer)
+}
+
+func cloneObject(object map[string]any) map[string]any {
+	clone := make(map[string]any, len(object))
+	for key, value := range object {
+		clone[key] = value
+	}
+
+	return clone
+}
+
+func deepCopy(value any) any {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+
+	var clone any
+	_ = json.Unmarshal(b, &clone)
+
+	return clone
+}
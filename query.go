@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var FilterOperators = []string{"ne", "gte", "gt", "lte", "lt", "like", "in", "null"}
+
+func ParseFilters(query url.Values, table *Table) ([]Filter, error) {
+	var filters []Filter
+
+	for key, values := range query {
+		if strings.HasPrefix(key, "_") {
+			continue
+		}
+
+		fieldName, operator := splitFilterKey(key, table)
+		field, ok := table.Definition[fieldName]
+		if !ok || field.Children {
+			return nil, errors.New("unknown filter field: " + fieldName)
+		}
+
+		if operator == "eq" && len(values) > 1 {
+			operator = "in"
+			values = []string{strings.Join(values, ",")}
+		}
+
+		for _, raw := range values {
+			filter, err := NewFilter(fieldName, operator, raw, field)
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, *filter)
+		}
+	}
+
+	return filters, nil
+}
+
+func ApplyFilters(collection EntityCollection, filters []Filter) EntityCollection {
+	for _, filter := range filters {
+		collection = filter.Apply(collection)
+	}
+
+	return collection
+}
+
+func NewFilter(fieldName string, operator string, raw string, field *Field) (*Filter, error) {
+	filter := &Filter{Field: fieldName, Operator: operator}
+
+	switch operator {
+	case "null":
+		isNull, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for filter %s_null: %s", fieldName, raw)
+		}
+		filter.Value = isNull
+	case "in":
+		var values []any
+		for _, part := range strings.Split(raw, ",") {
+			value, err := ParseFieldValue(field, part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for filter %s: %s", fieldName, part)
+			}
+			values = append(values, value)
+		}
+		filter.Value = values
+	case "like":
+		filter.Value = strings.ToLower(raw)
+	default:
+		value, err := ParseFieldValue(field, raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for filter %s: %s", fieldName, raw)
+		}
+		filter.Value = value
+	}
+
+	filter.Apply = func(collection EntityCollection) EntityCollection {
+		filtered := EntityCollection{}
+		for _, entity := range collection {
+			if filter.Matches(entity) {
+				filtered = append(filtered, entity)
+			}
+		}
+		return filtered
+	}
+
+	return filter, nil
+}
+
+func (f *Filter) Matches(entity Entity) bool {
+	value, exists := entity[f.Field]
+
+	switch f.Operator {
+	case "null":
+		return (!exists || value == nil) == f.Value.(bool)
+	case "like":
+		if value == nil {
+			return false
+		}
+		return strings.Contains(strings.ToLower(fmt.Sprint(value)), f.Value.(string))
+	case "eq":
+		if list, ok := value.([]any); ok {
+			return containsId(list, f.Value)
+		}
+	case "in":
+		if list, ok := value.([]any); ok {
+			for _, v := range f.Value.([]any) {
+				if containsId(list, v) {
+					return true
+				}
+			}
+			return false
+		}
+		for _, v := range f.Value.([]any) {
+			if cmp, ok := CompareValues(value, v); ok && cmp == 0 {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		cmp, ok := CompareValues(value, f.Value)
+		return !ok || cmp != 0
+	}
+
+	cmp, ok := CompareValues(value, f.Value)
+	if !ok {
+		return false
+	}
+
+	switch f.Operator {
+	case "eq":
+		return cmp == 0
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	case "lte":
+		return cmp <= 0
+	}
+
+	return false
+}
+
+func splitFilterKey(key string, table *Table) (string, string) {
+	if _, ok := table.Definition[key]; ok {
+		return key, "eq"
+	}
+
+	for _, operator := range FilterOperators {
+		if strings.HasSuffix(key, "_"+operator) {
+			return strings.TrimSuffix(key, "_"+operator), operator
+		}
+	}
+
+	return key, "eq"
+}
+
+// ParseFieldValue converts a raw query string value into the Go type the field's values are stored as.
+func ParseFieldValue(field *Field, raw string) (any, error) {
+	if raw == "null" {
+		return nil, nil
+	}
+
+	switch field.Type {
+	case "number":
+		return strconv.ParseFloat(raw, 64)
+	case "bool":
+		return strconv.ParseBool(raw)
+	case "id":
+		if field.Subtype == "uuid" {
+			return raw, nil
+		}
+		return strconv.ParseFloat(raw, 64)
+	case "date":
+		switch field.Subtype {
+		case "timestamp", "day", "year":
+			return strconv.ParseFloat(raw, 64)
+		}
+	}
+
+	return raw, nil
+}
+
+// CompareValues compares two field values, numerically if both can be read as numbers. The second return value is
+// false when the values are not comparable.
+func CompareValues(a any, b any) (int, bool) {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0, true
+		}
+		return 0, false
+	}
+
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	if ba, ok := a.(bool); ok {
+		if bb, ok := b.(bool); ok {
+			if ba == bb {
+				return 0, true
+			}
+			if !ba {
+				return -1, true
+			}
+			return 1, true
+		}
+		return 0, false
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)), true
+}
+
+func toFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+
+	return 0, false
+}
+
+type Page struct {
+	Number int
+	Limit  int
+	Offset int
+}
+
+func ParseSort(query url.Values, table *Table) ([]Sort, error) {
+	var sorts []Sort
+
+	orders := strings.Split(query.Get("_order"), ",")
+
+	for _, param := range query["_sort"] {
+		for i, fieldName := range strings.Split(param, ",") {
+			fieldName = strings.TrimSpace(fieldName)
+			if fieldName == "" {
+				continue
+			}
+
+			order := "asc"
+			if strings.HasPrefix(fieldName, "-") {
+				order = "desc"
+				fieldName = strings.TrimPrefix(fieldName, "-")
+			} else if i < len(orders) && strings.EqualFold(orders[i], "desc") {
+				order = "desc"
+			}
+
+			if field, ok := table.Definition[fieldName]; !ok || field.Children {
+				return nil, errors.New("unknown sort field: " + fieldName)
+			}
+
+			sorts = append(sorts, Sort{fieldName, order})
+		}
+	}
+
+	return sorts, nil
+}
+
+func SortCollection(collection EntityCollection, sorts []Sort) EntityCollection {
+	if len(sorts) == 0 {
+		return collection
+	}
+
+	sort.SliceStable(collection, func(i, j int) bool {
+		for _, s := range sorts {
+			cmp := compareForSort(collection[i][s.Field], collection[j][s.Field])
+			if cmp == 0 {
+				continue
+			}
+			if s.Order == "desc" {
+				return cmp > 0
+			}
+			return cmp < 0
+		}
+		return false
+	})
+
+	return collection
+}
+
+// compareForSort orders nil values after everything else so they end up last in ascending order.
+func compareForSort(a any, b any) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		}
+		return -1
+	}
+
+	cmp, _ := CompareValues(a, b)
+
+	return cmp
+}
+
+// ParsePagination reads either page based (_page, _limit) or offset based (_start/_offset, _end/_limit) pagination
+// from the query. It returns nil if the request doesn't ask for pagination.
+func ParsePagination(query url.Values) (*Page, error) {
+	readInt := func(key string) (int, bool, error) {
+		raw := query.Get(key)
+		if raw == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("invalid value for %s: %s", key, raw)
+		}
+		return n, true, nil
+	}
+
+	page, hasPage, err := readInt("_page")
+	if err != nil {
+		return nil, err
+	}
+	limit, hasLimit, err := readInt("_limit")
+	if err != nil {
+		return nil, err
+	}
+	if !hasLimit {
+		limit, hasLimit, err = readInt("_per_page")
+		if err != nil {
+			return nil, err
+		}
+	}
+	start, hasStart, err := readInt("_start")
+	if err != nil {
+		return nil, err
+	}
+	if !hasStart {
+		start, hasStart, err = readInt("_offset")
+		if err != nil {
+			return nil, err
+		}
+	}
+	end, hasEnd, err := readInt("_end")
+	if err != nil {
+		return nil, err
+	}
+
+	if hasPage {
+		if page < 1 {
+			page = 1
+		}
+		if !hasLimit || limit < 1 {
+			limit = config.PageSize
+		}
+		return &Page{page, limit, (page - 1) * limit}, nil
+	}
+
+	if hasStart || hasEnd || hasLimit {
+		if hasEnd {
+			limit = max(end-start, 0)
+		} else if !hasLimit {
+			limit = config.PageSize
+		}
+		return &Page{0, limit, start}, nil
+	}
+
+	return nil, nil
+}
+
+func Paginate(collection EntityCollection, page *Page) PaginatedItems {
+	count := len(collection)
+	result := PaginatedItems{Count: count, Items: EntityCollection{}}
+
+	if page.Limit > 0 {
+		result.Pages = (count + page.Limit - 1) / page.Limit
+	}
+	if result.Pages > 0 {
+		result.First = 1
+		result.Last = result.Pages
+	}
+
+	current := 1
+	if page.Limit > 0 {
+		current = page.Offset/page.Limit + 1
+	}
+	if current > 1 && current-1 <= result.Pages {
+		result.Prev = current - 1
+	}
+	if current < result.Pages {
+		result.Next = current + 1
+	}
+
+	if page.Offset < count {
+		end := min(page.Offset+page.Limit, count)
+		result.Items = collection[page.Offset:end]
+	}
+
+	return result
+}
+
+// PaginationLinks builds an RFC 8288 Link header value pointing to the first, previous, next and last pages.
+func PaginationLinks(base *url.URL, items PaginatedItems, page *Page) string {
+	link := func(n int, rel string) string {
+		u := *base
+		query := u.Query()
+		if page.Number > 0 {
+			query.Set("_page", strconv.Itoa(n))
+			query.Set("_limit", strconv.Itoa(page.Limit))
+		} else {
+			query.Del("_offset")
+			query.Del("_end")
+			query.Set("_start", strconv.Itoa((n-1)*page.Limit))
+			query.Set("_limit", strconv.Itoa(page.Limit))
+		}
+		u.RawQuery = query.Encode()
+		return "<" + u.String() + ">; rel=\"" + rel + "\""
+	}
+
+	var links []string
+	if items.First > 0 {
+		links = append(links, link(items.First, "first"))
+	}
+	if items.Prev > 0 {
+		links = append(links, link(items.Prev, "prev"))
+	}
+	if items.Next > 0 {
+		links = append(links, link(items.Next, "next"))
+	}
+	if items.Last > 0 {
+		links = append(links, link(items.Last, "last"))
+	}
+
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	OnDeleteRestrict = "restrict"
+	OnDeleteCascade  = "cascade"
+	OnDeleteSetNull  = "set-null"
+)
+
+var ErrReferenced = errors.New("entity is still referenced")
+
+type Reference struct {
+	Table    string
+	Many     bool
+	OnDelete string
+}
+
+// Reference parses the params of a `ref:<table>[],<on-delete>` field. It returns nil for fields of other types. A
+// single reference that isn't nullable can't be set to null, so `set-null` falls back to `restrict` for it.
+func (f *Field) Reference() *Reference {
+	ref := f.parseReference()
+	if ref != nil && ref.OnDelete == OnDeleteSetNull && !ref.Many && !f.Nullable {
+		ref.OnDelete = OnDeleteRestrict
+	}
+
+	return ref
+}
+
+func (f *Field) parseReference() *Reference {
+	if f.Type != "ref" {
+		return nil
+	}
+
+	params := strings.Split(strings.TrimPrefix(f.Params, ":"), ",")
+	ref := &Reference{OnDelete: OnDeleteRestrict}
+
+	ref.Table = strings.ToLower(strings.TrimSpace(params[0]))
+	if strings.HasSuffix(ref.Table, "[]") {
+		ref.Many = true
+		ref.Table = strings.TrimSuffix(ref.Table, "[]")
+	}
+
+	if len(params) > 1 {
+		switch strings.TrimSpace(params[1]) {
+		case OnDeleteCascade:
+			ref.OnDelete = OnDeleteCascade
+		case OnDeleteSetNull, "setnull", "null":
+			ref.OnDelete = OnDeleteSetNull
+		}
+	}
+
+	return ref
+}
+
+// WarnReferences warns about the `set-null` references of the table that fall back to `restrict`.
+func WarnReferences(table *Table) {
+	for key, field := range table.Definition {
+		if ref := field.parseReference(); ref != nil && field.Reference().OnDelete != ref.OnDelete {
+			Warn("Reference can't be set to null because the field isn't nullable, deletes are restricted instead", "table", table.Name, "field", key)
+		}
+	}
+}
+
+func GenerateReference(field Field, table *Table) any {
+	ref := field.Reference()
+	ids := table.Database().tableIds(ref.Table)
+
+	if ref.Many {
+		picked := []any{}
+		if len(ids) == 0 {
+			return picked
+		}
+		rand.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+		return append(picked, ids[:rand.IntN(min(len(ids), 3)+1)]...)
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return ids[rand.IntN(len(ids))]
+}
+
+func ValidateReference(field *Field, value any, key string, table *Table) *ValidationResult {
+	ref := field.Reference()
+	database := table.Database()
+
+	target, ok := database.Tables[ref.Table]
+	if !ok {
+		return &ValidationResult{false, []string{"Unknown table " + ref.Table + " referenced by field: " + key}}
+	}
+
+	var values []any
+	if ref.Many {
+		list, ok := value.([]any)
+		if !ok {
+			return &ValidationResult{false, []string{"Expected a list of IDs for field: " + key}}
+		}
+		values = list
+	} else {
+		values = []any{value}
+	}
+
+	for _, v := range values {
+		exists, err := database.Storage.Contains(target, "id", v)
+		if err != nil {
+			return &ValidationResult{false, []string{err.Error()}}
+		}
+		if !exists {
+			return &ValidationResult{false, []string{fmt.Sprintf("Referenced %s with ID %v doesn't exist for field: %s", ref.Table, v, key)}}
+		}
+	}
+
+	return &ValidationResult{true, nil}
+}
+
+// RemoveWithReferences removes the entities and applies the on-delete rule of every reference pointing to them.
+// Nothing is changed if a restricting reference is found, unless the referencing entity is removed too.
+func RemoveWithReferences(table *Table, ids ...string) error {
+	database := table.Database()
+	plan := &deletePlan{database: database, deletes: map[string][]Entity{}, deleted: map[string]map[string]bool{}, indexes: map[string]map[string][]Entity{}}
+
+	for _, id := range ids {
+		entity, found, err := database.Storage.Get(table, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		err = plan.add(table, entity)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := plan.check()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range plan.order {
+		err = removeRows(database.Tables[name], plan.deletes[name])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, other := range database.Tables {
+		// Only the tables referencing a table with removed entities are read.
+		refs := map[string]*Reference{}
+		for fieldName, field := range other.Definition {
+			if ref := field.Reference(); ref != nil && len(plan.deleted[ref.Table]) > 0 {
+				refs[fieldName] = ref
+			}
+		}
+		if len(refs) == 0 {
+			continue
+		}
+
+		var changed []Entity
+		changedIds := map[string]bool{}
+
+		collection, err := ReadTable(other)
+		if err != nil {
+			return err
+		}
+
+		for fieldName, ref := range refs {
+			for _, row := range collection {
+				var cleared any
+				if list, ok := row[fieldName].([]any); ok && ref.Many {
+					cleared = slices.DeleteFunc(slices.Clone(list), func(v any) bool { return plan.deleted[ref.Table][deleteKey(v)] })
+					if len(cleared.([]any)) == len(list) {
+						continue
+					}
+				} else if row[fieldName] == nil || !plan.deleted[ref.Table][deleteKey(row[fieldName])] {
+					continue
+				}
+
+				row[fieldName] = cleared
+				if key := deleteKey(row["id"]); !changedIds[key] {
+					changedIds[key] = true
+					changed = append(changed, row)
+				}
+			}
+		}
+
+		if len(changed) > 0 {
+			err = WriteTable(other, collection)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range changed {
+				PublishChange(EventUpdated, other, row)
+			}
+		}
+	}
+
+	return nil
+}
+
+// deletePlan collects the entities removed by a delete, following cascading references.
+type deletePlan struct {
+	database *Database
+	order    []string
+	deletes  map[string][]Entity
+	deleted  map[string]map[string]bool
+	// indexes map the referenced IDs to the entities referencing them, by table and field.
+	indexes map[string]map[string][]Entity
+}
+
+func (p *deletePlan) add(table *Table, entity Entity) error {
+	key := deleteKey(entity["id"])
+	if p.deleted[table.Name][key] {
+		return nil
+	}
+
+	if p.deleted[table.Name] == nil {
+		p.deleted[table.Name] = map[string]bool{}
+		p.order = append(p.order, table.Name)
+	}
+	p.deleted[table.Name][key] = true
+	p.deletes[table.Name] = append(p.deletes[table.Name], entity)
+
+	for _, other := range p.database.Tables {
+		for fieldName, field := range other.Definition {
+			ref := field.Reference()
+			if ref == nil || ref.Table != table.Name || ref.OnDelete != OnDeleteCascade || ref.Many {
+				continue
+			}
+
+			index, err := p.index(other, fieldName)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range index[key] {
+				err = p.add(other, row)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// check fails if a restricting reference points to a removed entity from an entity that isn't removed.
+func (p *deletePlan) check() error {
+	for _, other := range p.database.Tables {
+		for fieldName, field := range other.Definition {
+			ref := field.Reference()
+			if ref == nil || ref.OnDelete != OnDeleteRestrict || len(p.deleted[ref.Table]) == 0 {
+				continue
+			}
+
+			index, err := p.index(other, fieldName)
+			if err != nil {
+				return err
+			}
+
+			for key := range p.deleted[ref.Table] {
+				for _, row := range index[key] {
+					if !p.deleted[other.Name][deleteKey(row["id"])] {
+						return fmt.Errorf("%w by %s %v (field %s)", ErrReferenced, other.Name, row["id"], fieldName)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *deletePlan) index(table *Table, field string) (map[string][]Entity, error) {
+	name := table.Name + "." + field
+	if index, ok := p.indexes[name]; ok {
+		return index, nil
+	}
+
+	collection, err := ReadTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[string][]Entity{}
+	for _, row := range collection {
+		values, ok := row[field].([]any)
+		if !ok {
+			values = []any{row[field]}
+		}
+
+		for _, value := range values {
+			if value != nil {
+				index[deleteKey(value)] = append(index[deleteKey(value)], row)
+			}
+		}
+	}
+	p.indexes[name] = index
+
+	return index, nil
+}
+
+// deleteKey returns the key of the ID in a delete plan. IDs sent as strings match the numbers they stand for.
+func deleteKey(id any) string {
+	if s, ok := id.(string); ok {
+		if n, err := strconv.ParseFloat(s, 64); err == nil {
+			return IdKey(n)
+		}
+	}
+
+	return IdKey(id)
+}
+
+// removeRows removes the entities from the table. A table losing all its entities is replaced at once instead of
+// removing them one by one.
+func removeRows(table *Table, entities []Entity) error {
+	ids, err := table.Database().Storage.Ids(table)
+	if err != nil {
+		return err
+	}
+
+	if len(entities) < len(ids) {
+		for _, entity := range entities {
+			err = RemoveById(table, IdKey(entity["id"]))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = WriteTable(table, EntityCollection{})
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		PublishChange(EventDeleted, table, entity)
+	}
+
+	return nil
+}
+
+func (d *Database) tableIds(name string) []any {
+	table, ok := d.Tables[name]
+	if !ok {
+		return nil
+	}
+
+	ids, err := d.Storage.Ids(table)
+	if err != nil {
+		return nil
+	}
+
+	return ids
+}
+
+func containsId(ids []any, value any) bool {
+	for _, id := range ids {
+		if cmp, ok := CompareValues(id, value); ok && cmp == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ChildrenField creates the definition of a `"<name>[]": "<table>.json"` property, which lists the entities of another
+// table referencing this one. The children aren't stored, they're only embedded into responses on request.
+func ChildrenField(definition string) *Field {
+	name := strings.ToLower(strings.TrimSuffix(path.Base(definition), path.Ext(definition)))
+
+	return &Field{Type: "children", Params: ":" + name, Children: true}
+}
+
+func (f *Field) ChildTable() string {
+	return strings.TrimPrefix(f.Params, ":")
+}
+
+// ForeignKey returns the field of the child table that references the parent table. The first `ref` field pointing to
+// the parent is used, falling back to a field named `<parent>_id`.
+func ForeignKey(child *Table, parent string) string {
+	keys := make([]string, 0, len(child.Definition))
+	for key := range child.Definition {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if ref := child.Definition[key].Reference(); ref != nil && ref.Table == parent {
+			return key
+		}
+	}
+
+	if _, ok := child.Definition[parent+"_id"]; ok {
+		return parent + "_id"
+	}
+
+	return ""
+}
+
+// FindChildren returns the entities of the child table whose foreign key points to the parent entity, limited by the
+// scope filters.
+func FindChildren(child *Table, parent string, id any, scope ...Filter) (EntityCollection, error) {
+	key := ForeignKey(child, parent)
+	if key == "" {
+		return nil, fmt.Errorf("table %s has no field referencing %s", child.Name, parent)
+	}
+
+	filter, err := NewFilter(key, "eq", fmt.Sprint(id), child.Definition[key])
+	if err != nil {
+		return nil, err
+	}
+
+	return QueryTable(child, append(scope, *filter))
+}
+
+// EmbedRelations adds the children listed in `_embed` and the referenced parents listed in `_expand` to the entities.
+// Entities of owned tables that don't belong to the caller are left out, and tables whose GET rules the request doesn't
+// satisfy return the error of Authorize.
+func EmbedRelations(ctx context.Context, collection EntityCollection, table *Table, query url.Values, caller *Caller) (EntityCollection, error) {
+	embeds := splitParam(query["_embed"])
+	expands := splitParam(query["_expand"])
+
+	if len(embeds) == 0 && len(expands) == 0 {
+		return collection, nil
+	}
+
+	result := make(EntityCollection, len(collection))
+	for i, entity := range collection {
+		result[i] = Entity(cloneObject(entity))
+	}
+
+	for _, name := range embeds {
+		child, ok := embedTable(table, name)
+		if !ok {
+			return nil, errors.New("unknown relation to embed: " + name)
+		}
+
+		err := Authorize(ctx, child.Name, http.MethodGet)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entity := range result {
+			children, err := FindChildren(child, table.Name, entity["id"], caller.Owner(child).Scope()...)
+			if err != nil {
+				return nil, err
+			}
+			entity[name] = children
+		}
+	}
+
+	for _, name := range expands {
+		key, ref := expandField(table, name)
+		if ref == nil {
+			return nil, errors.New("unknown relation to expand: " + name)
+		}
+
+		parent, ok := table.Database().Tables[ref.Table]
+		if !ok {
+			return nil, errors.New("unknown table: " + ref.Table)
+		}
+
+		err := Authorize(ctx, parent.Name, http.MethodGet)
+		if err != nil {
+			return nil, err
+		}
+
+		parents, err := QueryTable(parent, caller.Owner(parent).Scope())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entity := range result {
+			if ref.Many {
+				expanded := EntityCollection{}
+				list, _ := entity[key].([]any)
+				for _, id := range list {
+					if found, ok := findInCollection(parents, id); ok {
+						expanded = append(expanded, found)
+					}
+				}
+				entity[name] = expanded
+			} else if found, ok := findInCollection(parents, entity[key]); ok {
+				entity[name] = found
+			} else {
+				entity[name] = nil
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func embedTable(table *Table, name string) (*Table, bool) {
+	if field, ok := table.Definition[name]; ok && field.Children {
+		child, ok := table.Database().Tables[field.ChildTable()]
+		return child, ok
+	}
+
+	child, ok := table.Database().Tables[name]
+	if !ok || ForeignKey(child, table.Name) == "" {
+		return nil, false
+	}
+
+	return child, true
+}
+
+func expandField(table *Table, name string) (string, *Reference) {
+	for _, key := range []string{name, name + "_id", name + "Id"} {
+		if field, ok := table.Definition[key]; ok {
+			if ref := field.Reference(); ref != nil {
+				return key, ref
+			}
+		}
+	}
+
+	for key, field := range table.Definition {
+		if ref := field.Reference(); ref != nil && ref.Table == name {
+			return key, ref
+		}
+	}
+
+	return "", nil
+}
+
+func findInCollection(collection EntityCollection, id any) (Entity, bool) {
+	if id == nil {
+		return nil, false
+	}
+
+	for _, entity := range collection {
+		if MatchesId(entity["id"], fmt.Sprint(id)) {
+			return entity, true
+		}
+	}
+
+	return nil, false
+}
+
+func splitParam(values []string) []string {
+	var parts []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+
+	return parts
+}
+
+// tableDependencies returns the names of the tables referenced by the fields in the definition file.
+func tableDependencies(table *Table) []string {
+	var dependencies []string
+
+	entityJSON, err := ReadDefinition(table)
+	if err != nil {
+		return nil
+	}
+
+	for _, value := range entityJSON {
+		field := GetFieldType(value)
+		if ref := field.Reference(); ref != nil && ref.Table != table.Name {
+			dependencies = append(dependencies, ref.Table)
+		}
+	}
+
+	return dependencies
+}
+
+// HydrationOrder sorts the tables so that referenced tables are generated before the tables referencing them.
+func HydrationOrder(tables map[string]*Table) []string {
+	var order []string
+	visited := map[string]bool{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+
+		table, ok := tables[name]
+		if !ok {
+			return
+		}
+
+		for _, dependency := range tableDependencies(table) {
+			visit(dependency)
+		}
+
+		order = append(order, name)
+	}
+
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		visit(name)
+	}
+
+	return order
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const ScenarioHeader = "X-Amock-Scenario"
+
+// DefaultScenario selects the default database, even when another scenario is active.
+const DefaultScenario = "default"
+
+var ErrUnknownScenario = errors.New("unknown scenario")
+
+// ScenarioConfig describes how the data of a scenario differs from the seeded data of the default database.
+type ScenarioConfig struct {
+	Description string              `yaml:"description" json:"description"`
+	Replace     map[string][]Entity `yaml:"replace" json:"replace"`
+	Overlay     map[string][]Entity `yaml:"overlay" json:"overlay"`
+	Generate    map[string]int      `yaml:"generate" json:"generate"`
+}
+
+type ScenarioInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Active      bool   `json:"active"`
+}
+
+// Scenarios holds a separate in-memory database for every configured scenario.
+type Scenarios struct {
+	mu        sync.RWMutex
+	configs   map[string]ScenarioConfig
+	databases map[string]*Database
+	active    string
+}
+
+var scenarios = &Scenarios{configs: map[string]ScenarioConfig{}, databases: map[string]*Database{}}
+
+// BuildScenarios builds the databases of the scenarios from the seeded data.
+func BuildScenarios(configs map[string]ScenarioConfig) error {
+	databases := map[string]*Database{}
+
+	for name, scenario := range configs {
+		if name == DefaultScenario {
+			return fmt.Errorf("scenario name %s is reserved", DefaultScenario)
+		}
+
+		database, err := NewScenarioDatabase(name, scenario)
+		if err != nil {
+			return fmt.Errorf("could not build scenario %s: %w", name, err)
+		}
+
+		databases[name] = database
+	}
+
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+
+	scenarios.configs = configs
+	scenarios.databases = databases
+
+	return nil
+}
+
+// ResetScenarios restores the seeded state of the scenario databases, discarding the changes made to them.
+func ResetScenarios() error {
+	scenarios.mu.RLock()
+	databases := slices.Collect(maps.Values(scenarios.databases))
+	scenarios.mu.RUnlock()
+
+	for _, database := range databases {
+		unlock := database.LockAll()
+		err := ResetDatabase(database)
+		unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func NewScenarioDatabase(name string, scenario ScenarioConfig) (*Database, error) {
+	for _, tables := range []map[string][]Entity{scenario.Replace, scenario.Overlay} {
+		for tableName := range tables {
+			if _, ok := db.Tables[tableName]; !ok {
+				return nil, errors.New("unknown table " + tableName)
+			}
+		}
+	}
+	for tableName := range scenario.Generate {
+		if _, ok := db.Tables[tableName]; !ok {
+			return nil, errors.New("unknown table " + tableName)
+		}
+	}
+
+	database := &Database{Tables: map[string]*Table{}, Storage: NewMemoryStorage(), Scenario: name}
+
+	for tableName, table := range db.Tables {
+		database.Tables[tableName] = &Table{
+			Name:           table.Name,
+			File:           table.File,
+			DefinitionFile: table.DefinitionFile,
+			Definition:     table.Definition,
+			SchemaFile:     table.SchemaFile,
+			LastAutoID:     db.seeds[tableName].LastAutoID,
+			db:             database,
+		}
+	}
+
+	for _, tableName := range HydrationOrder(database.Tables) {
+		table := database.Tables[tableName]
+
+		rows := copyCollection(db.seeds[tableName].Rows)
+		if replacement, ok := scenario.Replace[tableName]; ok {
+			rows = copyCollection(replacement)
+		}
+
+		err := database.Storage.SaveSchema(table)
+		if err == nil {
+			err = database.Storage.Replace(table, rows)
+		}
+		if err == nil {
+			err = overlayRows(table, scenario.Overlay[tableName])
+		}
+		if err == nil {
+			err = ReconcileAutoID(table)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		Touch(table)
+
+		for i := 0; i < scenario.Generate[tableName]; i++ {
+			entity := Entity{}
+			for key, field := range table.Definition {
+				if !field.Children {
+					entity[key], table = GenerateEntityField(*field, table)
+				}
+			}
+
+			err = database.Storage.Insert(table, entity)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := RecordSeeds(database)
+	if err != nil {
+		return nil, err
+	}
+
+	return database, nil
+}
+
+// overlayRows merges the rows into the entities with the same ID and inserts the rows without a match.
+func overlayRows(table *Table, rows []Entity) error {
+	for _, row := range rows {
+		row = normalizeEntity(row)
+
+		if row["id"] == nil {
+			return fmt.Errorf("overlay of table %s has a row without an id", table.Name)
+		}
+
+		id := fmt.Sprint(row["id"])
+		existing, found, err := table.Database().Storage.Get(table, id)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			err = table.Database().Storage.Insert(table, row)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for key, value := range row {
+			existing[key] = value
+		}
+
+		_, err = table.Database().Storage.Update(table, id, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ScenarioDatabase returns the database of the scenario. An empty name selects the active scenario.
+func ScenarioDatabase(name string) (*Database, error) {
+	scenarios.mu.RLock()
+	defer scenarios.mu.RUnlock()
+
+	if name == "" {
+		name = scenarios.active
+	}
+
+	if name == "" || name == DefaultScenario {
+		return &db, nil
+	}
+
+	database, ok := scenarios.databases[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownScenario, name)
+	}
+
+	return database, nil
+}
+
+// RequestDatabase returns the database selected by the scenario header of the request, or by the active scenario. If
+// the request has a session, the database of the session is returned instead.
+func RequestDatabase(r *http.Request) (*Database, error) {
+	database, err := ScenarioDatabase(r.Header.Get(ScenarioHeader))
+	if err != nil {
+		return nil, err
+	}
+
+	if id := requestSession(r); id != "" {
+		return sessions.Open(id, database).Database, nil
+	}
+
+	return database, nil
+}
+
+type databaseContextKey struct{}
+
+func WithDatabase(ctx context.Context, database *Database) context.Context {
+	return context.WithValue(ctx, databaseContextKey{}, database)
+}
+
+// ContextTable returns the table with the same name from the database stored in the context, falling back to the
+// table itself.
+func ContextTable(ctx context.Context, table *Table) *Table {
+	database, ok := ctx.Value(databaseContextKey{}).(*Database)
+	if !ok {
+		return table
+	}
+
+	if scoped, ok := database.Tables[table.Name]; ok {
+		return scoped
+	}
+
+	return table
+}
+
+// databaseHandler resolves the database selected by the request before calling the handler.
+func databaseHandler(handle func(http.ResponseWriter, *http.Request, httprouter.Params, *Database)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		database, err := RequestDatabase(r)
+		if err != nil {
+			http.Error(w, "Unknown scenario: "+r.Header.Get(ScenarioHeader), http.StatusBadRequest)
+			return
+		}
+
+		handle(w, r, ps, database)
+	}
+}
+
+// tableHandler resolves the table of the database selected by the request before calling the handler.
+func tableHandler(table *Table, handle func(http.ResponseWriter, *http.Request, httprouter.Params, *Table)) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		database, err := RequestDatabase(r)
+		if err != nil {
+			http.Error(w, "Unknown scenario: "+r.Header.Get(ScenarioHeader), http.StatusBadRequest)
+			return
+		}
+
+		handle(w, r, ps, database.Tables[table.Name])
+	}
+}
+
+func ListScenarios() []ScenarioInfo {
+	scenarios.mu.RLock()
+	defer scenarios.mu.RUnlock()
+
+	list := []ScenarioInfo{{Name: DefaultScenario, Active: scenarios.active == ""}}
+	names := make([]string, 0, len(scenarios.configs))
+	for name := range scenarios.configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		list = append(list, ScenarioInfo{Name: name, Description: scenarios.configs[name].Description, Active: scenarios.active == name})
+	}
+
+	return list
+}
+
+func ActivateScenario(name string) error {
+	scenarios.mu.Lock()
+	defer scenarios.mu.Unlock()
+
+	if name == DefaultScenario {
+		name = ""
+	}
+
+	if _, ok := scenarios.databases[name]; !ok && name != "" {
+		return fmt.Errorf("%w: %s", ErrUnknownScenario, name)
+	}
+
+	scenarios.active = name
+
+	return nil
+}
+
+func handleListScenarios(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	writeAdminJSON(w, http.StatusOK, ListScenarios())
+}
+
+func handleGetScenario(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, scenario := range ListScenarios() {
+		if scenario.Active {
+			writeAdminJSON(w, http.StatusOK, scenario)
+			return
+		}
+	}
+}
+
+func handleActivateScenario(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var body struct {
+		Name string `json:"name"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = ActivateScenario(body.Name)
+	if err != nil {
+		http.Error(w, "Unknown scenario: "+body.Name, http.StatusNotFound)
+		return
+	}
+
+	handleGetScenario(w, r, ps)
+}
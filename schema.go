@@ -15,6 +15,10 @@ func ValidateField(field *Field, value any, key string, table *Table) *Validatio
 		return &ValidationResult{true, nil}
 	}
 
+	if field.Type == "ref" {
+		return ValidateReference(field, value, key, table)
+	}
+
 	if field.Type == "enum" {
 		params := strings.Split(strings.TrimPrefix(field.Params, ":"), ",")
 		for _, param := range params {
@@ -31,17 +35,11 @@ func ValidateField(field *Field, value any, key string, table *Table) *Validatio
 		}
 		return &ValidationResult{false, []string{"Invalid UUID format for field: " + key}}
 	} else if field.Type == "id" && field.Subtype != "uuid" {
-		entities, err := ReadTable(table)
+		exists, err := table.Database().Storage.Contains(table, key, value)
 		if err != nil {
 			return &ValidationResult{false, []string{err.Error()}}
 		}
-		idExists := false
-		for _, entity := range entities {
-			if entity[key] == value {
-				idExists = true
-			}
-		}
-		if !idExists {
+		if !exists {
 			return &ValidationResult{true, nil}
 		} else {
 			return &ValidationResult{false, []string{"Duplicate ID for field: " + key}}
@@ -59,13 +57,7 @@ func ValidateField(field *Field, value any, key string, table *Table) *Validatio
 			return &ValidationResult{true, nil}
 		}
 		return &ValidationResult{false, []string{"Invalid value for field: " + key}}
-	case float32:
-	case float64:
-	case int:
-	case int8:
-	case int16:
-	case int32:
-	case int64:
+	case float32, float64, int, int8, int16, int32, int64:
 		if field.Type == "number" {
 			return &ValidationResult{true, nil}
 		}
@@ -78,6 +70,4 @@ func ValidateField(field *Field, value any, key string, table *Table) *Validatio
 	default:
 		return &ValidationResult{false, []string{"Invalid value for field: " + key}}
 	}
-
-	return &ValidationResult{true, nil}
 }
@@ -2,7 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
@@ -27,57 +33,96 @@ func InitHandlers(config *Config, db *Database) *httprouter.Router {
 
 	for _, table := range db.Tables {
 		Routes = append(Routes, Route{"GET", "/" + table.Name})
-		router.GET("/"+table.Name, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			content, err := GetTable(&table)
+		router.GET("/"+table.Name, tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
+			handleGetCollection(w, r, table, RequestOwner(r, table).Scope()...)
+		}))
 
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		Routes = append(Routes, Route{"GET", "/" + table.Name + "/_events"})
+		Routes = append(Routes, Route{"GET", "/" + table.Name + "/:id"})
+		router.GET("/"+table.Name+"/:id", tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
+			// httprouter doesn't allow a static segment next to :id, so the event stream is served from here.
+			if ps.ByName("id") == "_events" {
+				handleEvents(w, r, table.Database(), table.Name)
 				return
 			}
 
-			w.Header().Set("Content-Type", "application/json")
+			format, ok := requestFormat(w, r)
+			if !ok {
+				return
+			}
 
-			_, _ = w.Write(content)
-		})
+			entity, ok := findOwned(w, r, table, ps.ByName("id"))
+			if !ok {
+				return
+			}
 
-		Routes = append(Routes, Route{"GET", "/" + table.Name + "/:id"})
-		router.GET("/"+table.Name+"/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			content, err := GetEntityById(&table, ps.ByName("id"))
+			embedded, err := EmbedRelations(r.Context(), EntityCollection{entity}, table, r.URL.Query(), RequestCaller(r))
 
 			if err != nil {
-				if strings.Contains(err.Error(), "entity not found") {
-					http.Error(w, "Entity not found", http.StatusNotFound)
-					return
-				}
+				handleEmbedError(w, r, err)
+				return
+			}
 
+			content, err := json.Marshal(embedded[0])
+
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 
+			modified := relationsModified(table, r.URL.Query(), EntityModified(table, IdKey(entity["id"])))
+			if notModified(w, r, FormatETag(ETag(content), format), modified) {
+				return
+			}
+
+			if format != FormatJSON {
+				writeFormatted(w, table, format, embedded, true)
+				return
+			}
+
 			w.Header().Set("Content-Type", "application/json")
 
 			_, _ = w.Write(content)
-		})
+		}))
 
 		Routes = append(Routes, Route{"POST", "/" + table.Name})
-		router.POST("/"+table.Name, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		router.POST("/"+table.Name, tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
 			Debug("POST request received", "table", table.Name)
-			handlePost(w, r, &table)
-		})
+			handlePost(w, r, table, nil)
+		}))
 
-		Routes = append(Routes, Route{"PUT", "/" + table.Name})
-		router.PUT("/"+table.Name, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		Routes = append(Routes, Route{"PUT", "/" + table.Name + "/:id"})
+		router.PUT("/"+table.Name+"/:id", tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
 			Debug("PUT request received", "table", table.Name)
-			handlePost(w, r, &table)
-		})
+			handlePut(w, r, table, ps.ByName("id"))
+		}))
+
+		Routes = append(Routes, Route{"PATCH", "/" + table.Name + "/:id"})
+		router.PATCH("/"+table.Name+"/:id", tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
+			Debug("PATCH request received", "table", table.Name)
+			handlePatch(w, r, table, ps.ByName("id"))
+		}))
 
 		Routes = append(Routes, Route{"DELETE", "/" + table.Name + "/:id"})
-		router.DELETE("/"+table.Name+"/:id", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		router.DELETE("/"+table.Name+"/:id", tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
 			Debug("DELETE request received", "table", table.Name)
 
-			err := RemoveById(&table, ps.ByName("id"))
+			unlock := table.Database().LockAll()
+			defer unlock()
+
+			entity, ok := findOwned(w, r, table, ps.ByName("id"))
+			if !ok || !checkPreconditions(w, r, table, entity) {
+				return
+			}
+
+			err := RemoveWithReferences(table, ps.ByName("id"))
 
 			if err != nil {
+				if errors.Is(err, ErrReferenced) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -85,7 +130,88 @@ func InitHandlers(config *Config, db *Database) *httprouter.Router {
 			w.Header().Set("Content-Type", "application/json")
 
 			_, _ = w.Write([]byte(`{"message": "Entity removed"}`))
-		})
+		}))
+
+		for fieldName, field := range table.Definition {
+			if !field.Children {
+				continue
+			}
+
+			childName := field.ChildTable()
+
+			Routes = append(Routes, Route{"GET", "/" + table.Name + "/:id/" + fieldName})
+			router.GET("/"+table.Name+"/:id/"+fieldName, tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
+				child, key, parent, ok := resolveChildren(w, r, table, childName, ps.ByName("id"))
+				if !ok {
+					return
+				}
+
+				scope, err := NewFilter(key, "eq", fmt.Sprint(parent["id"]), child.Definition[key])
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				handleGetCollection(w, r, child, append(RequestOwner(r, child).Scope(), *scope)...)
+			}))
+
+			Routes = append(Routes, Route{"POST", "/" + table.Name + "/:id/" + fieldName})
+			router.POST("/"+table.Name+"/:id/"+fieldName, tableHandler(table, func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, table *Table) {
+				Debug("POST request received", "table", childName, "parent", table.Name)
+
+				child, key, parent, ok := resolveChildren(w, r, table, childName, ps.ByName("id"))
+				if !ok {
+					return
+				}
+
+				var value any = parent["id"]
+				if child.Definition[key].Reference() != nil && child.Definition[key].Reference().Many {
+					value = []any{parent["id"]}
+				}
+
+				handlePost(w, r, child, Entity{key: value})
+			}))
+		}
+	}
+
+	router.GET(OpenAPIPath, handleOpenAPI)
+	router.GET(DocsPath, handleDocs)
+	router.GET(EventsPath, databaseHandler(handleAllEvents))
+	router.GET(WebSocketPath, databaseHandler(handleWebSocket))
+	InitAdminHandlers(router)
+
+	for name, field := range config.Ownership.Tables {
+		if table, ok := db.Tables[name]; !ok || table.Definition[field] == nil {
+			Warn("Unknown owned table or owner field", "table", name, "field", field)
+		}
+	}
+
+	if config.Auth.Table != "" {
+		if _, ok := db.Tables[config.Auth.Table]; !ok {
+			Warn("Unknown users table for authentication", "table", config.Auth.Table)
+		}
+		auth = NewAuth(config.Auth)
+		InitAuthHandlers(router)
+
+		if config.Auth.OIDC.Enabled {
+			var err error
+			oidc, err = NewOIDC(config.Auth.OIDC, constructUrl()+auth.config.Path)
+			if err != nil {
+				Error("Error starting the OIDC provider", "error", err)
+			} else {
+				InitOIDCHandlers(router)
+			}
+		}
+	}
+
+	if config.GraphQL {
+		schema, err := NewGraphQLSchema(db.Tables)
+		if err != nil {
+			Error("Error building GraphQL schema", "error", err)
+		} else {
+			router.GET(GraphQLPath, GraphQLHandler(schema))
+			router.POST(GraphQLPath, GraphQLHandler(schema))
+		}
 	}
 
 	Debug("Handlers initialized")
@@ -93,7 +219,146 @@ func InitHandlers(config *Config, db *Database) *httprouter.Router {
 	return router
 }
 
-func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
+func resolveChildren(w http.ResponseWriter, r *http.Request, table *Table, childName string, id string) (*Table, string, Entity, bool) {
+	child, ok := table.Database().Tables[childName]
+	if !ok {
+		http.Error(w, "Unknown table: "+childName, http.StatusInternalServerError)
+		return nil, "", nil, false
+	}
+
+	key := ForeignKey(child, table.Name)
+	if key == "" {
+		http.Error(w, "Table "+childName+" has no field referencing "+table.Name, http.StatusInternalServerError)
+		return nil, "", nil, false
+	}
+
+	// The rules of the parent table are checked by Authenticate, the ones of the child table here.
+	err := Authorize(r.Context(), child.Name, r.Method)
+	if err != nil {
+		handleAuthorizeError(w, r, err)
+		return nil, "", nil, false
+	}
+
+	parent, ok := findOwned(w, r, table, id)
+	if !ok {
+		return nil, "", nil, false
+	}
+
+	return child, key, parent, true
+}
+
+// handleEmbedError responds with 401 or 403 for the relations the auth rules don't allow and 400 for unknown ones.
+func handleEmbedError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrAuthenticationRequired) || errors.Is(err, ErrForbidden) {
+		handleAuthorizeError(w, r, err)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func handleGetCollection(w http.ResponseWriter, r *http.Request, table *Table, scope ...Filter) {
+	query := r.URL.Query()
+
+	format, ok := requestFormat(w, r)
+	if !ok {
+		return
+	}
+
+	filters, err := ParseFilters(query, table)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sorts, err := ParseSort(query, table)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := ParsePagination(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	collection, err := QueryTable(table, append(scope, filters...))
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	collection = SortCollection(collection, sorts)
+
+	var response any
+	var items EntityCollection
+
+	if page != nil {
+		paginated := Paginate(collection, page)
+		paginated.Items, err = EmbedRelations(r.Context(), paginated.Items, table, query, RequestCaller(r))
+		if err != nil {
+			handleEmbedError(w, r, err)
+			return
+		}
+
+		items = paginated.Items
+
+		// Only JSON has an envelope, other formats always get the pagination headers.
+		if config.Pagination == "envelope" && format == FormatJSON {
+			response = paginated
+		} else {
+			response = paginated.Items
+			w.Header().Set("X-Total-Count", strconv.Itoa(paginated.Count))
+			if links := PaginationLinks(requestUrl(r), paginated, page); links != "" {
+				w.Header().Set("Link", links)
+			}
+		}
+	} else {
+		items, err = EmbedRelations(r.Context(), collection, table, query, RequestCaller(r))
+		if err != nil {
+			handleEmbedError(w, r, err)
+			return
+		}
+		response = items
+	}
+
+	content, err := json.Marshal(response)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The pagination headers are part of the representation, so they change the ETag too.
+	tag := ETag(content, []byte(w.Header().Get("X-Total-Count")), []byte(w.Header().Get("Link")))
+	if notModified(w, r, FormatETag(tag, format), relationsModified(table, query, TableModified(table))) {
+		return
+	}
+
+	if format != FormatJSON {
+		writeFormatted(w, table, format, items, false)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _ = w.Write(content)
+}
+
+func requestUrl(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+}
+
+// handlePost creates entities from the request body. Fields in fixed are set on every created entity, overriding the
+// values from the body.
+func handlePost(w http.ResponseWriter, r *http.Request, table *Table, fixed Entity) {
 	contentType := r.Header.Get("Content-Type")
 	Debug("Content-Type is " + contentType)
 
@@ -106,10 +371,20 @@ func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
 			return
 		}
 
+		unlock := table.LockForWrite()
+		defer unlock()
+
+		owner := RequestOwner(r, table)
+
 		switch data := jsonData.(type) {
 		case map[string]interface{}:
 			Debug("JSON object received")
 			// handle JSON object
+			for key, value := range fixed {
+				data[key] = value
+			}
+			owner.Apply(data, true)
+
 			response, newEntity, newTable := handleJsonObject(data, table)
 			if !response.Success {
 				http.Error(w, response.Message, response.Code)
@@ -123,18 +398,30 @@ func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
 				return
 			}
 
+			w.Header().Set("ETag", EntityETag(*newEntity))
+
 			err = json.NewEncoder(w).Encode(&newEntity)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			db.Tables[newTable.Name] = *newTable
-		case []map[string]interface{}:
+		case []interface{}:
 			// handle JSON array
 			var collection = EntityCollection{}
 			newTable := table
-			for _, item := range data {
+			ids := map[string]bool{}
+			for _, raw := range data {
+				item, ok := raw.(map[string]interface{})
+				if !ok {
+					http.Error(w, "Invalid JSON", http.StatusBadRequest)
+					return
+				}
+
+				for key, value := range fixed {
+					item[key] = value
+				}
+				owner.Apply(item, true)
+
 				var response HTTPResponse
 				var newEntity *Entity
 				response, newEntity, newTable = handleJsonObject(item, table)
@@ -143,6 +430,14 @@ func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
 					return
 				}
 
+				if id, ok := (*newEntity)["id"]; ok {
+					if ids[IdKey(id)] {
+						http.Error(w, "Duplicate ID for field: id", http.StatusBadRequest)
+						return
+					}
+					ids[IdKey(id)] = true
+				}
+
 				collection = append(collection, *newEntity)
 			}
 
@@ -163,8 +458,6 @@ func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-
-			db.Tables[newTable.Name] = *newTable
 		default:
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
@@ -176,6 +469,134 @@ func handlePost(w http.ResponseWriter, r *http.Request, table *Table) {
 	w.Header().Set("Content-Type", "application/json")
 }
 
+func handlePut(w http.ResponseWriter, r *http.Request, table *Table, id string) {
+	if mediaType(r) != "application/json" {
+		http.Error(w, "Invalid content type", http.StatusBadRequest)
+		return
+	}
+
+	var data Entity
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := table.LockForWrite()
+	defer unlock()
+
+	existing, ok := findOwned(w, r, table, id)
+	if !ok || !checkPreconditions(w, r, table, existing) {
+		return
+	}
+
+	RequestOwner(r, table).Apply(data, false)
+
+	entity, response := updateEntityFromData(data, table, existing)
+	if !response.Success {
+		http.Error(w, response.Message, response.Code)
+		return
+	}
+
+	saveUpdatedEntity(w, table, id, entity)
+}
+
+func handlePatch(w http.ResponseWriter, r *http.Request, table *Table, id string) {
+	var (
+		operations []PatchOperation
+		patch      any
+		err        error
+	)
+
+	contentType := mediaType(r)
+
+	switch contentType {
+	case "application/json-patch+json":
+		err = json.NewDecoder(r.Body).Decode(&operations)
+	case "application/merge-patch+json", "application/json":
+		err = json.NewDecoder(r.Body).Decode(&patch)
+	default:
+		w.Header().Set("Accept-Patch", "application/merge-patch+json, application/json-patch+json")
+		http.Error(w, "Invalid content type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := table.LockForWrite()
+	defer unlock()
+
+	existing, ok := findOwned(w, r, table, id)
+	if !ok || !checkPreconditions(w, r, table, existing) {
+		return
+	}
+
+	var patched any
+
+	if contentType == "application/json-patch+json" {
+		patched, err = ApplyJSONPatch(map[string]any(existing), operations)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		patched = ApplyMergePatch(map[string]any(existing), patch)
+	}
+
+	data, ok := patched.(map[string]any)
+	if !ok {
+		http.Error(w, "Patched entity must be a JSON object", http.StatusUnprocessableEntity)
+		return
+	}
+
+	RequestOwner(r, table).Apply(data, false)
+
+	entity, response := updateEntityFromData(data, table, existing)
+	if !response.Success {
+		http.Error(w, response.Message, response.Code)
+		return
+	}
+
+	saveUpdatedEntity(w, table, id, entity)
+}
+
+func saveUpdatedEntity(w http.ResponseWriter, table *Table, id string, entity *Entity) {
+	err := UpdateById(table, id, entity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", EntityETag(*entity))
+
+	err = json.NewEncoder(w).Encode(entity)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleFindError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), "entity not found") {
+		http.Error(w, "Entity not found", http.StatusNotFound)
+		return
+	}
+
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func mediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.ToLower(mediaType)
+}
+
 func handleJsonObject(data Entity, table *Table) (HTTPResponse, *Entity, *Table) {
 	var entity, newTable, response = createEntityFromData(data, table)
 
@@ -192,14 +613,16 @@ func createEntityFromData(data Entity, table *Table) (*Entity, *Table, HTTPRespo
 	// iterate over the JSON object and validate fields
 	for key, value := range data {
 		Debug("Validating field", "field", key, "value", value)
-		if field, ok := table.Definition[key]; ok {
+		if field, ok := table.Definition[key]; ok && field.Children {
+			return nil, nil, HTTPResponse{false, http.StatusUnprocessableEntity, "Field is a relation and can't be set: " + key}
+		} else if ok {
 			validation := ValidateField(field, value, key, table)
 			Debug("Validation result", "valid", validation.Valid, "errors", validation.Errors)
 			if validation.Valid {
 				entity[key] = value
 				if field.Type == "id" && field.Subtype != "uuid" {
-					if uint(value.(float64)) > table.LastAutoID {
-						table.LastAutoID = uint(value.(float64)) + 1
+					if n, ok := toFloat(value); ok && uint(n) >= table.LastAutoID {
+						table.LastAutoID = uint(n) + 1
 					}
 				}
 			} else {
@@ -212,7 +635,7 @@ func createEntityFromData(data Entity, table *Table) (*Entity, *Table, HTTPRespo
 
 	// check if all required fields are present and generate missing optional fields
 	for key, field := range table.Definition {
-		if _, ok := entity[key]; !ok {
+		if _, ok := entity[key]; !ok && !field.Children {
 			if field.Required {
 				return nil, nil, HTTPResponse{false, http.StatusBadRequest, "Missing required field: " + key}
 			}
@@ -222,3 +645,57 @@ func createEntityFromData(data Entity, table *Table) (*Entity, *Table, HTTPRespo
 	}
 	return &entity, table, HTTPResponse{true, http.StatusCreated, "Entity created!"}
 }
+
+// updateEntityFromData validates the new state of an existing entity. Fields that didn't change aren't validated
+// again and the ID can't be changed. Missing optional fields are set to null.
+func updateEntityFromData(data Entity, table *Table, existing Entity) (*Entity, HTTPResponse) {
+	entity := Entity{}
+
+	for key, value := range data {
+		field, ok := table.Definition[key]
+		if !ok {
+			return nil, HTTPResponse{false, http.StatusUnprocessableEntity, "Unknown field: " + key}
+		}
+
+		if field.Children {
+			return nil, HTTPResponse{false, http.StatusUnprocessableEntity, "Field is a relation and can't be set: " + key}
+		}
+
+		if key == "id" {
+			if cmp, ok := CompareValues(value, existing[key]); !ok || cmp != 0 {
+				return nil, HTTPResponse{false, http.StatusBadRequest, "Field id cannot be changed"}
+			}
+			entity[key] = existing[key]
+			continue
+		}
+
+		if old, ok := existing[key]; !ok || !reflect.DeepEqual(old, value) {
+			validation := ValidateField(field, value, key, table)
+			Debug("Validation result", "valid", validation.Valid, "errors", validation.Errors)
+			if !validation.Valid {
+				return nil, HTTPResponse{false, http.StatusBadRequest, validation.Errors[0]}
+			}
+		}
+
+		entity[key] = value
+	}
+
+	for key, field := range table.Definition {
+		if _, ok := entity[key]; ok || field.Children {
+			continue
+		}
+
+		if key == "id" {
+			entity[key] = existing[key]
+			continue
+		}
+
+		if field.Required {
+			return nil, HTTPResponse{false, http.StatusBadRequest, "Missing required field: " + key}
+		}
+
+		entity[key] = nil
+	}
+
+	return &entity, HTTPResponse{true, http.StatusOK, "Entity updated!"}
+}
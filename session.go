@@ -0,0 +1,289 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const SessionHeader = "X-Amock-Session"
+const SessionCookie = "amock_session"
+
+// Session is an isolated view of a database. Tables are shared with the parent database until the session changes
+// them.
+type Session struct {
+	Id       string    `json:"id"`
+	Scenario string    `json:"scenario,omitempty"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"lastUsed"`
+	Database *Database `json:"-"`
+}
+
+type Sessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+var sessions = &Sessions{sessions: map[string]*Session{}}
+
+// Open returns the session with the ID, creating it on top of the parent database if it doesn't exist yet.
+func (s *Sessions) Open(id string, parent *Database) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		session = &Session{Id: id, Scenario: parent.Scenario, Created: now, Database: NewSessionDatabase(id, parent)}
+		s.sessions[id] = session
+		Debug("Session created", "session", id, "scenario", parent.Scenario)
+	}
+
+	session.LastUsed = now
+
+	return session
+}
+
+func (s *Sessions) List() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, *session)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+
+	return list
+}
+
+func (s *Sessions) Close(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.sessions[id]
+	delete(s.sessions, id)
+
+	return ok
+}
+
+func (s *Sessions) CloseAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions = map[string]*Session{}
+}
+
+// Expire closes the sessions that weren't used for longer than the timeout.
+func (s *Sessions) Expire(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if time.Since(session.LastUsed) > timeout {
+			delete(s.sessions, id)
+			Debug("Session expired", "session", id)
+		}
+	}
+}
+
+// StartSessionCollector periodically closes the sessions inactive for longer than the timeout.
+func StartSessionCollector(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(min(timeout, time.Minute))
+		defer ticker.Stop()
+
+		for range ticker.C {
+			sessions.Expire(timeout)
+		}
+	}()
+}
+
+func NewSessionDatabase(id string, parent *Database) *Database {
+	database := &Database{Tables: map[string]*Table{}, Scenario: parent.Scenario, Session: id, seeds: parent.seeds}
+	database.Storage = NewCopyOnWriteStorage(parent)
+
+	for name, table := range parent.Tables {
+		unlock := LockTables(table)
+		database.Tables[name] = &Table{
+			Name:           table.Name,
+			File:           table.File,
+			DefinitionFile: table.DefinitionFile,
+			Definition:     table.Definition,
+			SchemaFile:     table.SchemaFile,
+			LastAutoID:     table.LastAutoID,
+			db:             database,
+		}
+		unlock()
+	}
+
+	return database
+}
+
+// requestSession returns the session ID from the session header or cookie of the request.
+func requestSession(r *http.Request) string {
+	if id := r.Header.Get(SessionHeader); id != "" {
+		return id
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		return cookie.Value
+	}
+
+	return ""
+}
+
+// CopyOnWriteStorage reads the tables from the parent database until they're changed. The first change copies the
+// table into memory, so the parent never sees it.
+type CopyOnWriteStorage struct {
+	mu     sync.Mutex
+	parent *Database
+	own    *MemoryStorage
+	copied map[string]bool
+}
+
+func NewCopyOnWriteStorage(parent *Database) *CopyOnWriteStorage {
+	return &CopyOnWriteStorage{parent: parent, own: NewMemoryStorage(), copied: map[string]bool{}}
+}
+
+// source returns the storage and the table holding the current data of the table.
+func (s *CopyOnWriteStorage) source(table *Table) (Storage, *Table) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parentTable, ok := s.parent.Tables[table.Name]
+	if s.copied[table.Name] || !ok {
+		return s.own, table
+	}
+
+	return s.parent.Storage, parentTable
+}
+
+func (s *CopyOnWriteStorage) copy(table *Table) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parentTable, ok := s.parent.Tables[table.Name]
+	if s.copied[table.Name] || !ok {
+		return nil
+	}
+
+	collection, err := s.parent.Storage.All(parentTable)
+	if err != nil {
+		return err
+	}
+
+	err = s.own.Replace(table, collection)
+	if err != nil {
+		return err
+	}
+
+	inheritModifications(table, parentTable)
+	s.copied[table.Name] = true
+
+	return nil
+}
+
+func (s *CopyOnWriteStorage) Exists(table *Table) bool {
+	storage, source := s.source(table)
+	return storage.Exists(source)
+}
+
+func (s *CopyOnWriteStorage) LoadSchema(table *Table) (map[string]*Field, error) {
+	storage, source := s.source(table)
+	return storage.LoadSchema(source)
+}
+
+func (s *CopyOnWriteStorage) SaveSchema(table *Table) error {
+	return s.own.SaveSchema(table)
+}
+
+func (s *CopyOnWriteStorage) All(table *Table) (EntityCollection, error) {
+	storage, source := s.source(table)
+	return storage.All(source)
+}
+
+func (s *CopyOnWriteStorage) Get(table *Table, id string) (Entity, bool, error) {
+	storage, source := s.source(table)
+	return storage.Get(source, id)
+}
+
+func (s *CopyOnWriteStorage) Query(table *Table, filters []Filter) (EntityCollection, error) {
+	storage, source := s.source(table)
+	return storage.Query(source, filters)
+}
+
+func (s *CopyOnWriteStorage) Ids(table *Table) ([]any, error) {
+	storage, source := s.source(table)
+	return storage.Ids(source)
+}
+
+func (s *CopyOnWriteStorage) Contains(table *Table, key string, value any) (bool, error) {
+	storage, source := s.source(table)
+	return storage.Contains(source, key, value)
+}
+
+func (s *CopyOnWriteStorage) Insert(table *Table, entities ...Entity) error {
+	err := s.copy(table)
+	if err != nil {
+		return err
+	}
+
+	return s.own.Insert(table, entities...)
+}
+
+func (s *CopyOnWriteStorage) Update(table *Table, id string, entity Entity) (bool, error) {
+	err := s.copy(table)
+	if err != nil {
+		return false, err
+	}
+
+	return s.own.Update(table, id, entity)
+}
+
+func (s *CopyOnWriteStorage) Delete(table *Table, id string) (bool, error) {
+	err := s.copy(table)
+	if err != nil {
+		return false, err
+	}
+
+	return s.own.Delete(table, id)
+}
+
+func (s *CopyOnWriteStorage) Replace(table *Table, collection EntityCollection) error {
+	s.mu.Lock()
+	s.copied[table.Name] = true
+	s.mu.Unlock()
+
+	return s.own.Replace(table, collection)
+}
+
+func (s *CopyOnWriteStorage) Flush() error {
+	return nil
+}
+
+func (s *CopyOnWriteStorage) Close() error {
+	return nil
+}
+
+func handleListSessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	writeAdminJSON(w, http.StatusOK, sessions.List())
+}
+
+func handleCloseSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !sessions.Close(ps.ByName("id")) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Session " + ps.ByName("id") + " closed"})
+}
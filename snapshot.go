@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var SnapshotsDir = path.Join(".amock", "snapshots")
+
+var ErrSnapshotName = errors.New("invalid snapshot name")
+
+var ErrSnapshotSchema = errors.New("the schema of the snapshot differs from the running server")
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+type SnapshotInfo struct {
+	Name    string    `json:"name"`
+	File    string    `json:"file"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// SnapshotFile returns the path of the archive of the named snapshot.
+func SnapshotFile(name string) (string, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return "", fmt.Errorf("%w %q, use only letters, digits, dots, dashes and underscores", ErrSnapshotName, name)
+	}
+
+	return path.Join(SnapshotsDir, name+".tar.gz"), nil
+}
+
+// SaveSnapshot writes the rows, schemas and metadata of all tables to a gzipped tar archive. The archive mirrors the
+// layout of the .amock directory, whatever storage is used.
+func SaveSnapshot(file string) error {
+	err := os.MkdirAll(path.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(path.Dir(file), path.Base(file)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create snapshot %s: %w", file, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = writeSnapshot(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		return fmt.Errorf("could not write snapshot %s: %w", file, err)
+	}
+
+	return nil
+}
+
+func writeSnapshot(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, value any) error {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		err = archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), ModTime: now})
+		if err != nil {
+			return err
+		}
+
+		_, err = archive.Write(b)
+		return err
+	}
+
+	for _, name := range sortedTableNames(db.Tables) {
+		table := db.Tables[name]
+
+		collection, err := ReadTable(table)
+		if err != nil {
+			return err
+		}
+
+		err = errors.Join(
+			add(path.Join("data", table.Name+".amock.json"), collection),
+			add(path.Join("schema", table.Name+".amock.schema.json"), table.Definition),
+			add(path.Join("tables", path.Base(table.MetaFile())), table),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.Join(archive.Close(), gz.Close())
+}
+
+// RestoreSnapshot replaces the data of the tables found in the snapshot. Tables missing from the snapshot are left
+// as they are. Schemas can only be replaced while the server isn't running, since requests read them without locking,
+// so a snapshot with a different schema is refused unless replaceSchemas is set. Nothing is restored if it's refused.
+func RestoreSnapshot(file string, replaceSchemas bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not open snapshot %s: %w", file, err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("could not read snapshot %s: %w", file, err)
+	}
+
+	files := map[string][]byte{}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read snapshot %s: %w", file, err)
+		}
+
+		files[header.Name], err = io.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("could not read snapshot %s: %w", file, err)
+		}
+	}
+
+	type restore struct {
+		table      *Table
+		collection EntityCollection
+		lastAutoID uint
+		definition map[string]*Field
+	}
+	var restores []restore
+
+	for _, name := range sortedTableNames(db.Tables) {
+		table := db.Tables[name]
+
+		data, ok := files[path.Join("data", table.Name+".amock.json")]
+		if !ok {
+			Warn("Table " + table.Name + " isn't in the snapshot, keeping its data")
+			continue
+		}
+
+		item := restore{table: table, lastAutoID: table.LastAutoID}
+
+		err = json.Unmarshal(data, &item.collection)
+		if err != nil {
+			return fmt.Errorf("could not unmarshal data of table %s: %w", table.Name, err)
+		}
+
+		if meta, ok := files[path.Join("tables", path.Base(table.MetaFile()))]; ok {
+			var stored Table
+			err = json.Unmarshal(meta, &stored)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal metadata of table %s: %w", table.Name, err)
+			}
+			item.lastAutoID = stored.LastAutoID
+		}
+
+		if schema, ok := files[path.Join("schema", table.Name+".amock.schema.json")]; ok {
+			definition := map[string]*Field{}
+			err = json.Unmarshal(schema, &definition)
+			if err != nil {
+				return fmt.Errorf("could not unmarshal schema of table %s: %w", table.Name, err)
+			}
+
+			if !reflect.DeepEqual(definition, table.Definition) {
+				if !replaceSchemas {
+					return fmt.Errorf("%w for table %s, restore it with the snapshot command while the server is stopped", ErrSnapshotSchema, table.Name)
+				}
+				item.definition = definition
+			}
+		}
+
+		restores = append(restores, item)
+	}
+
+	for _, item := range restores {
+		table := item.table
+		table.LastAutoID = item.lastAutoID
+
+		if item.definition != nil {
+			table.Definition = item.definition
+			err = table.Database().Storage.SaveSchema(table)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = WriteTable(table, item.collection)
+		if err == nil {
+			err = ReconcileAutoID(table)
+		}
+		if err == nil {
+			err = SaveTable(table)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func ListSnapshots() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(SnapshotsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []SnapshotInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".tar.gz")
+		if entry.IsDir() || !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{
+			Name:    name,
+			File:    path.Join(SnapshotsDir, entry.Name()),
+			Size:    info.Size(),
+			Created: info.ModTime().UTC(),
+		})
+	}
+
+	return snapshots, nil
+}
+
+func snapshotCommand(args []string) error {
+	usage := errors.New("usage: amock snapshot <save|restore|delete> <name> or amock snapshot list")
+	if len(args) < 1 {
+		return usage
+	}
+
+	if args[0] == "list" {
+		snapshots, err := ListSnapshots()
+		if err != nil {
+			return err
+		}
+
+		for _, snapshot := range snapshots {
+			println(snapshot.Name + "\t" + snapshot.Created.Local().Format(time.DateTime) + "\t" + snapshot.File)
+		}
+
+		return nil
+	}
+
+	if len(args) < 2 || !slices.Contains([]string{"save", "restore", "delete"}, args[0]) {
+		return usage
+	}
+
+	// A path to an archive can be given instead of a name, e.g. to keep the snapshot next to the tests using it.
+	file := args[1]
+	if !strings.HasSuffix(file, ".tar.gz") {
+		var err error
+		file, err = SnapshotFile(args[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	if args[0] == "delete" {
+		err := os.Remove(file)
+		if err != nil {
+			return err
+		}
+
+		println("Snapshot " + file + " deleted")
+
+		return nil
+	}
+
+	initDatabase()
+	defer db.Storage.Close()
+
+	if args[0] == "save" {
+		err := SaveSnapshot(file)
+		if err != nil {
+			return err
+		}
+
+		println("Snapshot saved to " + file)
+
+		return nil
+	}
+
+	err := RestoreSnapshot(file, true)
+	if err != nil {
+		return err
+	}
+
+	println("Snapshot " + file + " restored")
+
+	return nil
+}
+
+func handleListSnapshots(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	snapshots, err := ListSnapshots()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, snapshots)
+}
+
+func handleSaveSnapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	unlock := db.LockAll()
+	defer unlock()
+
+	file, err := SnapshotFile(ps.ByName("name"))
+	if err == nil {
+		err = SaveSnapshot(file)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), snapshotErrorCode(err))
+		return
+	}
+
+	writeAdminJSON(w, http.StatusCreated, map[string]any{"message": "Snapshot " + ps.ByName("name") + " saved", "file": file})
+}
+
+func handleRestoreSnapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	unlock := db.LockAll()
+	defer unlock()
+
+	file, err := SnapshotFile(ps.ByName("name"))
+	if err == nil {
+		err = RestoreSnapshot(file, false)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), snapshotErrorCode(err))
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Snapshot " + ps.ByName("name") + " restored"})
+}
+
+func handleDownloadSnapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	file, err := SnapshotFile(ps.ByName("name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if _, err = os.Stat(file); err != nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+path.Base(file)+`"`)
+
+	http.ServeFile(w, r, file)
+}
+
+func handleDeleteSnapshot(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	file, err := SnapshotFile(ps.ByName("name"))
+	if err == nil {
+		err = os.Remove(file)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), snapshotErrorCode(err))
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, map[string]any{"message": "Snapshot " + ps.ByName("name") + " deleted"})
+}
+
+func snapshotErrorCode(err error) int {
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, ErrSnapshotName) {
+		return http.StatusBadRequest
+	}
+	if errors.Is(err, ErrSnapshotSchema) {
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestRestoreSnapshotConcurrently restores a snapshot while other clients read and write the tables through REST,
+// GraphQL and the OpenAPI document. Run it with -race.
+func TestRestoreSnapshotConcurrently(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{GraphQL: true}, testEntities))
+	defer server.Close()
+
+	res, _ := request(t, http.MethodPost, server.URL+AdminPath+"/snapshots/base", nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("saving the snapshot responded with %d", res.StatusCode)
+	}
+
+	clients := []func() (*http.Response, error){
+		func() (*http.Response, error) { return http.Get(server.URL + "/user") },
+		func() (*http.Response, error) { return http.Get(server.URL + "/user/1?_embed=posts") },
+		func() (*http.Response, error) { return http.Get(server.URL + "/post?_expand=user&_format=csv") },
+		func() (*http.Response, error) { return http.Get(server.URL + OpenAPIPath) },
+		func() (*http.Response, error) {
+			return http.Post(server.URL+GraphQLPath, "application/json", strings.NewReader(`{"query": "{ allUser { id name posts { id title } } }"}`))
+		},
+		func() (*http.Response, error) {
+			return http.Post(server.URL+"/user", "application/json", strings.NewReader(`{"name": "Jane"}`))
+		},
+		func() (*http.Response, error) {
+			return http.Post(server.URL+"/post", "application/json", strings.NewReader(`{"user_id": 1, "title": "Hello"}`))
+		},
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for _, client := range clients {
+		wg.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				res, err := client()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				res.Body.Close()
+
+				if res.StatusCode >= http.StatusInternalServerError {
+					t.Errorf("%s %s responded with %d", res.Request.Method, res.Request.URL, res.StatusCode)
+				}
+			}
+		})
+	}
+
+	for range 20 {
+		res, content := request(t, http.MethodPost, server.URL+AdminPath+"/snapshots/base/restore", nil)
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("restoring the snapshot responded with %d: %s", res.StatusCode, content)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	res, _ = request(t, http.MethodPost, server.URL+AdminPath+"/snapshots/base/restore", nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("restoring the snapshot responded with %d", res.StatusCode)
+	}
+
+	_, content := request(t, http.MethodGet, server.URL+"/user", nil)
+
+	var users EntityCollection
+	err := json.Unmarshal(content, &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != config.InitCount {
+		t.Errorf("expected the %d users of the snapshot, got %d", config.InitCount, len(users))
+	}
+
+	res, content = request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "John"})
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(content), `"id":6`) {
+		t.Errorf("expected the ID sequence to continue after the restored users, got %d: %s", res.StatusCode, content)
+	}
+}
+
+func TestRestoreSnapshotRefusesSchemaChanges(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{}, testEntities))
+	defer server.Close()
+
+	res, _ := request(t, http.MethodPost, server.URL+AdminPath+"/snapshots/base", nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("saving the snapshot responded with %d", res.StatusCode)
+	}
+
+	res, _ = request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "John"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating a user responded with %d", res.StatusCode)
+	}
+
+	// The running server has a different schema than the one in the snapshot.
+	definition := db.Tables["user"].Definition
+	db.Tables["user"].Definition = map[string]*Field{}
+	for key, field := range definition {
+		if key != "email" {
+			db.Tables["user"].Definition[key] = field
+		}
+	}
+
+	res, _ = request(t, http.MethodPost, server.URL+AdminPath+"/snapshots/base/restore", nil)
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("expected 409 for a snapshot with another schema, got %d", res.StatusCode)
+	}
+
+	ids, err := db.Storage.Ids(db.Tables["user"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != config.InitCount+1 {
+		t.Errorf("expected the refused restore to keep the data, got %d users", len(ids))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	StorageJSON   = "json"
+	StorageSQLite = "sqlite"
+	StorageMemory = "memory"
+)
+
+// Storage persists the tables of the database. Entities are identified by the string form of their `id` field.
+type Storage interface {
+	// Exists reports whether the storage already holds data and a schema for the table.
+	Exists(table *Table) bool
+	LoadSchema(table *Table) (map[string]*Field, error)
+	SaveSchema(table *Table) error
+
+	All(table *Table) (EntityCollection, error)
+	Get(table *Table, id string) (Entity, bool, error)
+	Query(table *Table, filters []Filter) (EntityCollection, error)
+	Ids(table *Table) ([]any, error)
+	// Contains reports whether any entity of the table has the value in the field.
+	Contains(table *Table, key string, value any) (bool, error)
+
+	Insert(table *Table, entities ...Entity) error
+	Update(table *Table, id string, entity Entity) (bool, error)
+	Delete(table *Table, id string) (bool, error)
+	Replace(table *Table, collection EntityCollection) error
+
+	Flush() error
+	Close() error
+}
+
+func NewStorage(kind string) (Storage, error) {
+	switch kind {
+	case StorageJSON, "":
+		return NewJSONStorage(DataDir, SchemaDir), nil
+	case StorageMemory:
+		return NewMemoryStorage(), nil
+	case StorageSQLite:
+		return NewSQLiteStorage(config.SQLiteFile)
+	}
+
+	return nil, errors.New("unknown storage: " + kind)
+}
+
+// MemoryStorage keeps everything in memory. Nothing survives a restart.
+type MemoryStorage struct {
+	mu      sync.Mutex
+	stores  map[string]*TableStore
+	schemas map[string]map[string]*Field
+	load    func(table *Table) (*TableStore, error)
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		stores:  map[string]*TableStore{},
+		schemas: map[string]map[string]*Field{},
+	}
+}
+
+func (s *MemoryStorage) store(table *Table) (*TableStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if store, ok := s.stores[table.Name]; ok {
+		return store, nil
+	}
+
+	if s.load == nil {
+		store := NewTableStore("")
+		s.stores[table.Name] = store
+		return store, nil
+	}
+
+	store, err := s.load(table)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stores[table.Name] = store
+
+	return store, nil
+}
+
+func (s *MemoryStorage) Exists(table *Table) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.schemas[table.Name]
+
+	return ok
+}
+
+func (s *MemoryStorage) LoadSchema(table *Table) (map[string]*Field, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schema, ok := s.schemas[table.Name]
+	if !ok {
+		return nil, errors.New("no schema for table " + table.Name)
+	}
+
+	return schema, nil
+}
+
+func (s *MemoryStorage) SaveSchema(table *Table) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schemas[table.Name] = table.Definition
+
+	return nil
+}
+
+func (s *MemoryStorage) All(table *Table) (EntityCollection, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.All(), nil
+}
+
+func (s *MemoryStorage) Get(table *Table, id string) (Entity, bool, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return nil, false, err
+	}
+
+	entity, ok := store.Get(id)
+
+	return entity, ok, nil
+}
+
+func (s *MemoryStorage) Query(table *Table, filters []Filter) (EntityCollection, error) {
+	collection, err := s.All(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return ApplyFilters(collection, filters), nil
+}
+
+func (s *MemoryStorage) Ids(table *Table) ([]any, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Ids(), nil
+}
+
+func (s *MemoryStorage) Contains(table *Table, key string, value any) (bool, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return false, err
+	}
+
+	return store.Exists(key, value), nil
+}
+
+func (s *MemoryStorage) Insert(table *Table, entities ...Entity) error {
+	store, err := s.store(table)
+	if err != nil {
+		return err
+	}
+
+	store.Insert(entities...)
+
+	return nil
+}
+
+func (s *MemoryStorage) Update(table *Table, id string, entity Entity) (bool, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return false, err
+	}
+
+	return store.Update(id, entity), nil
+}
+
+func (s *MemoryStorage) Delete(table *Table, id string) (bool, error) {
+	store, err := s.store(table)
+	if err != nil {
+		return false, err
+	}
+
+	return store.Delete(id), nil
+}
+
+func (s *MemoryStorage) Replace(table *Table, collection EntityCollection) error {
+	store, err := s.store(table)
+	if err != nil {
+		return err
+	}
+
+	store.Replace(collection)
+
+	return nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	s.mu.Lock()
+	all := make([]*TableStore, 0, len(s.stores))
+	for _, store := range s.stores {
+		all = append(all, store)
+	}
+	s.mu.Unlock()
+
+	var errs []error
+	for _, store := range all {
+		errs = append(errs, store.Flush())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *MemoryStorage) Close() error {
+	return s.Flush()
+}
+
+// JSONStorage keeps the tables in memory and writes each of them to a JSON file in the data directory. Schemas are
+// stored next to them in the schema directory.
+type JSONStorage struct {
+	*MemoryStorage
+	dataDir   string
+	schemaDir string
+}
+
+func NewJSONStorage(dataDir string, schemaDir string) *JSONStorage {
+	s := &JSONStorage{MemoryStorage: NewMemoryStorage(), dataDir: dataDir, schemaDir: schemaDir}
+
+	s.load = func(table *Table) (*TableStore, error) {
+		return LoadTableStore(s.dataFile(table))
+	}
+
+	return s
+}
+
+func (s *JSONStorage) dataFile(table *Table) string {
+	return path.Join(s.dataDir, table.Name+".amock.json")
+}
+
+func (s *JSONStorage) schemaFile(table *Table) string {
+	return path.Join(s.schemaDir, table.Name+".amock.schema.json")
+}
+
+func (s *JSONStorage) Exists(table *Table) bool {
+	if _, err := os.Stat(s.dataFile(table)); err != nil {
+		return false
+	}
+
+	if _, err := os.Stat(s.schemaFile(table)); err != nil {
+		return false
+	}
+
+	return true
+}
+
+func (s *JSONStorage) LoadSchema(table *Table) (map[string]*Field, error) {
+	raw, err := os.ReadFile(s.schemaFile(table))
+	if err != nil {
+		return nil, fmt.Errorf("could not read file %s: %w", s.schemaFile(table), err)
+	}
+
+	var definition map[string]*Field
+
+	err = json.Unmarshal(raw, &definition)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal file %s: %w", s.schemaFile(table), err)
+	}
+
+	return definition, nil
+}
+
+func (s *JSONStorage) SaveSchema(table *Table) error {
+	b, err := json.Marshal(table.Definition)
+	if err != nil {
+		return fmt.Errorf("could not marshal schema: %w", err)
+	}
+
+	return WriteFileAtomic(s.schemaFile(table), b)
+}
+
+func (s *JSONStorage) Replace(table *Table, collection EntityCollection) error {
+	s.mu.Lock()
+	store, ok := s.stores[table.Name]
+	if !ok {
+		store = NewTableStore(s.dataFile(table))
+		s.stores[table.Name] = store
+	}
+	s.mu.Unlock()
+
+	store.Replace(collection)
+
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStorage stores every table in a table of an embedded SQLite database, with a column for every field of the
+// definition. Columns are declared without a type, so values keep the type they have in JSON. Lists are stored as JSON.
+type SQLiteStorage struct {
+	conn *sql.DB
+}
+
+func NewSQLiteStorage(file string) (*SQLiteStorage, error) {
+	conn, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database %s: %w", file, err)
+	}
+
+	conn.SetMaxOpenConns(1)
+
+	_, err = conn.Exec(`CREATE TABLE IF NOT EXISTS "__amock_schema" ("name" TEXT PRIMARY KEY, "definition" TEXT NOT NULL)`)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("could not create schema table in %s: %w", file, err)
+	}
+
+	return &SQLiteStorage{conn}, nil
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ensureTable creates the table for the definition and adds columns for fields that were added to it since.
+func (s *SQLiteStorage) ensureTable(table *Table) error {
+	columns := table.Columns()
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+	}
+	quoted[0] += " PRIMARY KEY"
+
+	_, err := s.conn.Exec("CREATE TABLE IF NOT EXISTS " + quoteIdentifier(table.Name) + " (" + strings.Join(quoted, ", ") + ")")
+	if err != nil {
+		return fmt.Errorf("could not create table %s: %w", table.Name, err)
+	}
+
+	rows, err := s.conn.Query("SELECT name FROM pragma_table_info(?)", table.Name)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	_ = rows.Close()
+
+	for _, column := range columns {
+		if !existing[column] {
+			_, err = s.conn.Exec("ALTER TABLE " + quoteIdentifier(table.Name) + " ADD COLUMN " + quoteIdentifier(column))
+			if err != nil {
+				return fmt.Errorf("could not add column %s to table %s: %w", column, table.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) Exists(table *Table) bool {
+	var exists int
+
+	err := s.conn.QueryRow(`SELECT 1 FROM "__amock_schema" WHERE "name" = ?`, table.Name).Scan(&exists)
+
+	return err == nil
+}
+
+func (s *SQLiteStorage) LoadSchema(table *Table) (map[string]*Field, error) {
+	var raw string
+
+	err := s.conn.QueryRow(`SELECT "definition" FROM "__amock_schema" WHERE "name" = ?`, table.Name).Scan(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema of table %s: %w", table.Name, err)
+	}
+
+	var definition map[string]*Field
+
+	err = json.Unmarshal([]byte(raw), &definition)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal schema of table %s: %w", table.Name, err)
+	}
+
+	return definition, nil
+}
+
+func (s *SQLiteStorage) SaveSchema(table *Table) error {
+	b, err := json.Marshal(table.Definition)
+	if err != nil {
+		return fmt.Errorf("could not marshal schema: %w", err)
+	}
+
+	_, err = s.conn.Exec(`INSERT INTO "__amock_schema" ("name", "definition") VALUES (?, ?) ON CONFLICT ("name") DO UPDATE SET "definition" = excluded."definition"`, table.Name, string(b))
+	if err != nil {
+		return fmt.Errorf("could not save schema of table %s: %w", table.Name, err)
+	}
+
+	return s.ensureTable(table)
+}
+
+func (s *SQLiteStorage) All(table *Table) (EntityCollection, error) {
+	return s.query(table, "", nil)
+}
+
+func (s *SQLiteStorage) Get(table *Table, id string) (Entity, bool, error) {
+	condition, args := idCondition(id)
+
+	collection, err := s.query(table, condition, args)
+	if err != nil || len(collection) == 0 {
+		return nil, false, err
+	}
+
+	return collection[0], true, nil
+}
+
+// Query translates the filters on scalar fields to SQL. Filters on lists and references are applied to the result.
+func (s *SQLiteStorage) Query(table *Table, filters []Filter) (EntityCollection, error) {
+	var (
+		conditions []string
+		args       []any
+		remaining  []Filter
+	)
+
+	for _, filter := range filters {
+		condition, filterArgs, ok := sqliteCondition(table, filter)
+		if !ok {
+			remaining = append(remaining, filter)
+			continue
+		}
+		conditions = append(conditions, condition)
+		args = append(args, filterArgs...)
+	}
+
+	collection, err := s.query(table, strings.Join(conditions, " AND "), args)
+	if err != nil {
+		return nil, err
+	}
+
+	return ApplyFilters(collection, remaining), nil
+}
+
+func (s *SQLiteStorage) Ids(table *Table) ([]any, error) {
+	rows, err := s.conn.Query(`SELECT "id" FROM ` + quoteIdentifier(table.Name) + ` ORDER BY rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read table %s: %w", table.Name, err)
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id any
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id != nil {
+			ids = append(ids, fromSQLiteValue(table.Definition["id"], id))
+		}
+	}
+
+	return ids, rows.Err()
+}
+
+func (s *SQLiteStorage) Contains(table *Table, key string, value any) (bool, error) {
+	var exists int
+
+	err := s.conn.QueryRow(`SELECT 1 FROM `+quoteIdentifier(table.Name)+` WHERE `+quoteIdentifier(key)+` = ? LIMIT 1`, toSQLiteValue(value)).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("could not read table %s: %w", table.Name, err)
+	}
+
+	return true, nil
+}
+
+func (s *SQLiteStorage) Insert(table *Table, entities ...Entity) error {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = s.insert(tx, table, entities)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) Update(table *Table, id string, entity Entity) (bool, error) {
+	columns := table.Columns()
+	assignments := make([]string, len(columns))
+	args := make([]any, len(columns))
+
+	entity = normalizeEntity(entity)
+	for i, column := range columns {
+		assignments[i] = quoteIdentifier(column) + " = ?"
+		args[i] = toSQLiteValue(entity[column])
+	}
+
+	condition, idArgs := idCondition(id)
+
+	result, err := s.conn.Exec("UPDATE "+quoteIdentifier(table.Name)+" SET "+strings.Join(assignments, ", ")+" WHERE "+condition, append(args, idArgs...)...)
+	if err != nil {
+		return false, fmt.Errorf("could not update table %s: %w", table.Name, err)
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (s *SQLiteStorage) Delete(table *Table, id string) (bool, error) {
+	condition, args := idCondition(id)
+
+	result, err := s.conn.Exec("DELETE FROM "+quoteIdentifier(table.Name)+" WHERE "+condition, args...)
+	if err != nil {
+		return false, fmt.Errorf("could not delete from table %s: %w", table.Name, err)
+	}
+
+	affected, err := result.RowsAffected()
+
+	return affected > 0, err
+}
+
+func (s *SQLiteStorage) Replace(table *Table, collection EntityCollection) error {
+	err := s.ensureTable(table)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM " + quoteIdentifier(table.Name))
+	if err == nil {
+		err = s.insert(tx, table, collection)
+	}
+
+	if err != nil {
+		_ = tx.Rollback()
+		return fmt.Errorf("could not replace table %s: %w", table.Name, err)
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) Flush() error {
+	return nil
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SQLiteStorage) insert(tx *sql.Tx, table *Table, entities []Entity) error {
+	columns := table.Columns()
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO " + quoteIdentifier(table.Name) + " (" + strings.Join(quoted, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")")
+	if err != nil {
+		return fmt.Errorf("could not insert into table %s: %w", table.Name, err)
+	}
+	defer stmt.Close()
+
+	for _, entity := range entities {
+		entity = normalizeEntity(entity)
+		args := make([]any, len(columns))
+		for i, column := range columns {
+			args[i] = toSQLiteValue(entity[column])
+		}
+
+		if _, err = stmt.Exec(args...); err != nil {
+			return fmt.Errorf("could not insert into table %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) query(table *Table, condition string, args []any) (EntityCollection, error) {
+	query := "SELECT * FROM " + quoteIdentifier(table.Name)
+	if condition != "" {
+		query += " WHERE " + condition
+	}
+	query += " ORDER BY rowid"
+
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read table %s: %w", table.Name, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	collection := EntityCollection{}
+
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err = rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+
+		entity := Entity{}
+		for i, column := range columns {
+			field, ok := table.Definition[column]
+			if !ok && column != "id" {
+				continue
+			}
+			entity[column] = fromSQLiteValue(field, values[i])
+		}
+
+		collection = append(collection, entity)
+	}
+
+	return collection, rows.Err()
+}
+
+func idCondition(id string) (string, []any) {
+	if n, err := strconv.ParseFloat(id, 64); err == nil {
+		return `("id" = ? OR "id" = ?)`, []any{n, id}
+	}
+
+	return `"id" = ?`, []any{id}
+}
+
+func toSQLiteValue(value any) any {
+	switch v := value.(type) {
+	case []any, map[string]any:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+
+	return value
+}
+
+func fromSQLiteValue(field *Field, value any) any {
+	switch v := value.(type) {
+	case int64:
+		if field != nil && field.Type == "bool" {
+			return v != 0
+		}
+		return float64(v)
+	case []byte:
+		value = string(v)
+	}
+
+	if s, ok := value.(string); ok && field != nil {
+		if ref := field.Reference(); ref != nil && ref.Many {
+			var list []any
+			if json.Unmarshal([]byte(s), &list) == nil {
+				return list
+			}
+		}
+	}
+
+	return value
+}
+
+// sqliteCondition translates a filter to SQL. It returns false for filters on fields whose values can't be compared
+// the same way in SQL, such as references and decimals stored as strings.
+func sqliteCondition(table *Table, filter Filter) (string, []any, bool) {
+	field, ok := table.Definition[filter.Field]
+	if !ok {
+		return "", nil, false
+	}
+
+	switch field.Type {
+	case "string", "enum", "bool", "id", "date":
+	case "number":
+		if field.Subtype == "decimal" {
+			return "", nil, false
+		}
+	default:
+		return "", nil, false
+	}
+
+	column := quoteIdentifier(filter.Field)
+
+	switch filter.Operator {
+	case "null":
+		if filter.Value.(bool) {
+			return column + " IS NULL", nil, true
+		}
+		return column + " IS NOT NULL", nil, true
+	case "like":
+		pattern := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(filter.Value.(string))
+		return "LOWER(CAST(" + column + " AS TEXT)) LIKE ? ESCAPE '\\'", []any{"%" + pattern + "%"}, true
+	case "in":
+		values := filter.Value.([]any)
+		if len(values) == 0 {
+			return "0", nil, true
+		}
+		placeholders := make([]string, len(values))
+		for i := range values {
+			placeholders[i] = "?"
+		}
+		return column + " IN (" + strings.Join(placeholders, ", ") + ")", values, true
+	}
+
+	if filter.Value == nil {
+		switch filter.Operator {
+		case "eq":
+			return column + " IS NULL", nil, true
+		case "ne":
+			return column + " IS NOT NULL", nil, true
+		}
+		return "0", nil, true
+	}
+
+	operators := map[string]string{"eq": "=", "gt": ">", "gte": ">=", "lt": "<", "lte": "<="}
+
+	if filter.Operator == "ne" {
+		return "(" + column + " IS NULL OR " + column + " != ?)", []any{filter.Value}, true
+	}
+
+	if operator, ok := operators[filter.Operator]; ok {
+		return column + " " + operator + " ?", []any{filter.Value}, true
+	}
+
+	return "", nil, false
+}
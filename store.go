@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TableStore keeps the entities of a table in memory, indexed by ID. If the store has a file, changes are written to
+// it in the background, debounced by config.FlushDelay.
+type TableStore struct {
+	mu      sync.RWMutex
+	writeMu sync.Mutex
+	file    string
+	rows    EntityCollection
+	index   map[string]int
+	dirty   bool
+	timer   *time.Timer
+}
+
+func NewTableStore(file string) *TableStore {
+	store := &TableStore{file: file}
+	store.setRows(nil)
+
+	return store
+}
+
+func LoadTableStore(file string) (*TableStore, error) {
+	store := &TableStore{file: file}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read file %s: %w", file, err)
+	}
+
+	var collection EntityCollection
+
+	err = json.Unmarshal(raw, &collection)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal file %s: %w", file, err)
+	}
+
+	store.setRows(collection)
+
+	return store, nil
+}
+
+func IdKey(id any) string {
+	switch v := id.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	}
+
+	return fmt.Sprint(id)
+}
+
+func (s *TableStore) All() EntityCollection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	collection := make(EntityCollection, len(s.rows))
+	for i, entity := range s.rows {
+		collection[i] = Entity(cloneObject(entity))
+	}
+
+	return collection
+}
+
+func (s *TableStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.rows)
+}
+
+func (s *TableStore) Get(id string) (Entity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i, ok := s.lookup(id)
+	if !ok {
+		return nil, false
+	}
+
+	return Entity(cloneObject(s.rows[i])), true
+}
+
+// Ids returns the IDs of all entities without copying the entities.
+func (s *TableStore) Ids() []any {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := make([]any, 0, len(s.rows))
+	for _, entity := range s.rows {
+		if id, ok := entity["id"]; ok && id != nil {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Exists reports whether any entity has the value in the field.
+func (s *TableStore) Exists(key string, value any) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if key == "id" {
+		_, ok := s.index[IdKey(value)]
+		return ok
+	}
+
+	for _, entity := range s.rows {
+		if cmp, ok := CompareValues(entity[key], value); ok && cmp == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *TableStore) Insert(entities ...Entity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, entity := range entities {
+		entity = normalizeEntity(entity)
+		s.rows = append(s.rows, entity)
+		if id, ok := entity["id"]; ok {
+			s.index[IdKey(id)] = len(s.rows) - 1
+		}
+	}
+
+	s.changed()
+}
+
+func (s *TableStore) Update(id string, entity Entity) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.lookup(id)
+	if !ok {
+		return false
+	}
+
+	s.rows[i] = normalizeEntity(entity)
+	s.changed()
+
+	return true
+}
+
+func (s *TableStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.lookup(id)
+	if !ok {
+		return false
+	}
+
+	s.setRows(append(s.rows[:i:i], s.rows[i+1:]...))
+	s.changed()
+
+	return true
+}
+
+func (s *TableStore) Replace(collection EntityCollection) {
+	normalized := make(EntityCollection, len(collection))
+	for i, entity := range collection {
+		normalized[i] = normalizeEntity(entity)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setRows(normalized)
+	s.changed()
+}
+
+// Flush writes the table to its data file if it has unsaved changes. The file is replaced atomically. If the write
+// fails, the changes stay unsaved and the flush is retried after the delay.
+func (s *TableStore) Flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !s.dirty || s.file == "" {
+		s.dirty = false
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.rows)
+	s.dirty = false
+	s.mu.Unlock()
+
+	if err == nil {
+		err = WriteFileAtomic(s.file, b)
+	} else {
+		err = fmt.Errorf("could not marshal collection: %w", err)
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		s.changed()
+		s.mu.Unlock()
+	}
+
+	return err
+}
+
+func (s *TableStore) setRows(collection EntityCollection) {
+	if collection == nil {
+		collection = EntityCollection{}
+	}
+
+	s.rows = collection
+	s.index = make(map[string]int, len(collection))
+
+	for i, entity := range collection {
+		if id, ok := entity["id"]; ok {
+			s.index[IdKey(id)] = i
+		}
+	}
+}
+
+func (s *TableStore) lookup(id string) (int, bool) {
+	if i, ok := s.index[id]; ok {
+		return i, true
+	}
+
+	if f, err := strconv.ParseFloat(id, 64); err == nil {
+		i, ok := s.index[IdKey(f)]
+		return i, ok
+	}
+
+	return 0, false
+}
+
+func (s *TableStore) changed() {
+	s.dirty = true
+
+	if s.timer == nil && s.file != "" {
+		s.timer = time.AfterFunc(time.Duration(config.FlushDelay)*time.Millisecond, func() {
+			if err := s.Flush(); err != nil {
+				Error("Error writing table", "file", s.file, "error", err)
+			}
+		})
+	}
+}
+
+// normalizeEntity converts the values of the entity to the types they'd have after a round trip through JSON, so that
+// generated entities compare the same way as entities read from a file.
+func normalizeEntity(entity Entity) Entity {
+	b, err := json.Marshal(entity)
+	if err != nil {
+		return Entity(cloneObject(entity))
+	}
+
+	var normalized Entity
+	if err = json.Unmarshal(b, &normalized); err != nil {
+		return Entity(cloneObject(entity))
+	}
+
+	return normalized
+}
+
+func WriteFileAtomic(file string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file for %s: %w", file, err)
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return errors.Join(fmt.Errorf("could not write file %s", file), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const WebhookDeliveriesPath = "/__amock/webhooks/deliveries"
+
+// WebhookLogSize is the number of deliveries kept in the delivery log.
+const WebhookLogSize = 200
+
+type WebhookConfig struct {
+	Url     string   `yaml:"url" json:"url"`
+	Tables  []string `yaml:"tables" json:"tables"`
+	Events  []string `yaml:"events" json:"events"`
+	Secret  string   `yaml:"secret" json:"secret"`
+	Retries *int     `yaml:"retries" json:"retries"`
+}
+
+func (c WebhookConfig) Matches(event Event) bool {
+	if len(c.Tables) > 0 && !slices.Contains(c.Tables, event.Table) {
+		return false
+	}
+
+	return len(c.Events) == 0 || slices.Contains(c.Events, event.Type)
+}
+
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Duration   string    `json:"duration"`
+}
+
+type WebhookDelivery struct {
+	Id       uint64           `json:"id"`
+	Url      string           `json:"url"`
+	Event    Event            `json:"event"`
+	Status   string           `json:"status"`
+	Attempts []WebhookAttempt `json:"attempts"`
+}
+
+// Webhooks sends the events of the bus to the configured URLs, retrying failed deliveries with exponential backoff.
+type Webhooks struct {
+	mu         sync.Mutex
+	hooks      []WebhookConfig
+	client     *http.Client
+	backoff    time.Duration
+	lastId     uint64
+	deliveries []*WebhookDelivery
+}
+
+var webhooks *Webhooks
+
+func NewWebhooks(hooks []WebhookConfig) *Webhooks {
+	return &Webhooks{
+		hooks:   hooks,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+	}
+}
+
+// StartWebhooks delivers the events published on the bus to the webhooks in the config.
+func StartWebhooks(bus *EventBus, hooks []WebhookConfig) *Webhooks {
+	w := NewWebhooks(hooks)
+
+	bus.Listen(func(event Event) {
+		// Synthetic events don't change any data, so there's nothing to tell.
+		if event.Synthetic {
+			return
+		}
+
+		for _, hook := range w.hooks {
+			if hook.Matches(event) {
+				go w.deliver(hook, event)
+			}
+		}
+	})
+
+	return w
+}
+
+func (w *Webhooks) deliver(hook WebhookConfig, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		Error("Error encoding webhook payload", "error", err)
+		return
+	}
+
+	delivery := w.record(hook, event)
+
+	retries := 3
+	if hook.Retries != nil {
+		retries = *hook.Retries
+	}
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(w.backoff * time.Duration(1<<(attempt-1)))
+		}
+
+		result := w.send(hook, delivery.Id, event, body)
+
+		w.mu.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		if result.Error == "" && result.StatusCode >= 200 && result.StatusCode < 300 {
+			delivery.Status = "delivered"
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		Warn("Webhook delivery failed", "url", hook.Url, "attempt", attempt+1, "status", result.StatusCode, "error", result.Error)
+	}
+
+	w.mu.Lock()
+	delivery.Status = "failed"
+	w.mu.Unlock()
+}
+
+func (w *Webhooks) send(hook WebhookConfig, deliveryId uint64, event Event, body []byte) WebhookAttempt {
+	start := time.Now()
+	result := WebhookAttempt{Time: start.UTC()}
+
+	request, err := http.NewRequest(http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		result.Duration = time.Since(start).String()
+		return result
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "amock-webhooks")
+	request.Header.Set("X-Amock-Event", event.Type)
+	request.Header.Set("X-Amock-Delivery", strconv.FormatUint(deliveryId, 10))
+
+	if hook.Secret != "" {
+		request.Header.Set("X-Amock-Signature", SignWebhook(hook.Secret, body))
+	}
+
+	response, err := w.client.Do(request)
+	result.Duration = time.Since(start).String()
+
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	_ = response.Body.Close()
+
+	result.StatusCode = response.StatusCode
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		result.Error = "unexpected status " + response.Status
+	}
+
+	return result
+}
+
+func (w *Webhooks) record(hook WebhookConfig, event Event) *WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.lastId++
+	delivery := &WebhookDelivery{Id: w.lastId, Url: hook.Url, Event: event, Status: "pending", Attempts: []WebhookAttempt{}}
+
+	w.deliveries = append(w.deliveries, delivery)
+	if len(w.deliveries) > WebhookLogSize {
+		w.deliveries = w.deliveries[len(w.deliveries)-WebhookLogSize:]
+	}
+
+	return delivery
+}
+
+// Deliveries returns the delivery log, newest first.
+func (w *Webhooks) Deliveries() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deliveries := make([]WebhookDelivery, 0, len(w.deliveries))
+	for i := len(w.deliveries) - 1; i >= 0; i-- {
+		delivery := *w.deliveries[i]
+		delivery.Attempts = slices.Clone(delivery.Attempts)
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries
+}
+
+// SignWebhook returns the value of the signature header, the hex encoded HMAC-SHA256 of the body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	deliveries := []WebhookDelivery{}
+	if webhooks != nil {
+		deliveries = webhooks.Deliveries()
+	}
+
+	content, err := json.Marshal(deliveries)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode deliveries: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _ = w.Write(content)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookReceiver returns a server passing the webhooks it receives to the channel. It responds with the status
+// codes in order, and with 200 after they run out.
+func newWebhookReceiver(t *testing.T, statusCodes ...int) (*httptest.Server, chan receivedWebhook) {
+	t.Helper()
+
+	received := make(chan receivedWebhook, 16)
+	var calls atomic.Int32
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedWebhook{r.Header.Clone(), body}
+
+		if call := int(calls.Add(1)); call <= len(statusCodes) {
+			w.WriteHeader(statusCodes[call-1])
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	return receiver, received
+}
+
+func waitForWebhook(t *testing.T, received chan receivedWebhook) receivedWebhook {
+	t.Helper()
+
+	select {
+	case webhook := <-received:
+		return webhook
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+	}
+
+	return receivedWebhook{}
+}
+
+// waitForDelivery waits until the newest delivery in the log isn't pending anymore.
+func waitForDelivery(t *testing.T, url string) WebhookDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		_, content := request(t, http.MethodGet, url+WebhookDeliveriesPath, nil)
+
+		var deliveries []WebhookDelivery
+		err := json.Unmarshal(content, &deliveries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(deliveries) > 0 && deliveries[0].Status != "pending" {
+			return deliveries[0]
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("the delivery didn't finish")
+
+	return WebhookDelivery{}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{}, testEntities))
+	defer server.Close()
+
+	receiver, received := newWebhookReceiver(t)
+	webhooks = StartWebhooks(Events, []WebhookConfig{{Url: receiver.URL, Tables: []string{"user"}, Events: []string{EventCreated}, Secret: "s3cret"}})
+
+	// Not sent, the webhook only wants new users.
+	request(t, http.MethodPatch, server.URL+"/user/1", map[string]any{"name": "Jane"})
+	request(t, http.MethodPost, server.URL+"/post", map[string]any{"user_id": 1, "title": "Hello"})
+
+	res, _ := request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "John"})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("creating a user responded with %d", res.StatusCode)
+	}
+
+	webhook := waitForWebhook(t, received)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(webhook.body)
+	if signature := "sha256=" + hex.EncodeToString(mac.Sum(nil)); webhook.header.Get("X-Amock-Signature") != signature {
+		t.Errorf("expected signature %s, got %s", signature, webhook.header.Get("X-Amock-Signature"))
+	}
+
+	if webhook.header.Get("X-Amock-Event") != EventCreated || webhook.header.Get("X-Amock-Delivery") == "" {
+		t.Errorf("unexpected headers %v", webhook.header)
+	}
+
+	var event Event
+	err := json.Unmarshal(webhook.body, &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventCreated || event.Table != "user" || event.Entity["name"] != "John" {
+		t.Errorf("unexpected payload %s", webhook.body)
+	}
+
+	select {
+	case webhook = <-received:
+		t.Errorf("unexpected webhook %s", webhook.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{}, testEntities))
+	defer server.Close()
+
+	receiver, received := newWebhookReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	webhooks = StartWebhooks(Events, []WebhookConfig{{Url: receiver.URL}})
+	webhooks.backoff = time.Millisecond
+
+	request(t, http.MethodPost, server.URL+"/user", map[string]any{"name": "John"})
+
+	var bodies []string
+	for range 3 {
+		bodies = append(bodies, string(waitForWebhook(t, received).body))
+	}
+	if bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+		t.Errorf("expected the same payload on every attempt, got %v", bodies)
+	}
+
+	delivery := waitForDelivery(t, server.URL)
+	if delivery.Status != "delivered" || len(delivery.Attempts) != 3 {
+		t.Fatalf("expected a delivery after 3 attempts, got %s after %d", delivery.Status, len(delivery.Attempts))
+	}
+	if delivery.Attempts[0].StatusCode != http.StatusInternalServerError || delivery.Attempts[2].StatusCode != http.StatusOK {
+		t.Errorf("unexpected attempts %+v", delivery.Attempts)
+	}
+}
+
+func TestWebhookGivesUpAfterRetries(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t, Config{}, testEntities))
+	defer server.Close()
+
+	retries := 1
+	receiver, received := newWebhookReceiver(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	webhooks = StartWebhooks(Events, []WebhookConfig{{Url: receiver.URL, Retries: &retries}})
+	webhooks.backoff = time.Millisecond
+
+	request(t, http.MethodDelete, server.URL+"/post/1", nil)
+
+	delivery := waitForDelivery(t, server.URL)
+	if delivery.Status != "failed" || len(delivery.Attempts) != 2 {
+		t.Errorf("expected a failed delivery after 2 attempts, got %s after %d", delivery.Status, len(delivery.Attempts))
+	}
+	if len(received) != 2 {
+		t.Errorf("expected 2 requests, got %d", len(received))
+	}
+}